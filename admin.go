@@ -0,0 +1,571 @@
+// This file contains the administrative endpoints used to operate an instance
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+var (
+	// adminKey is the bearer token required by the admin endpoints, they're
+	// disabled entirely when it isn't configured. Once set it's also needed to
+	// start crawls.
+	adminKey = GetenvOrDefault("RARITYMON_ADMIN_KEY", "")
+
+	// readKey is the bearer token required by the public endpoints, which are
+	// open when it isn't configured. The admin key is accepted as well.
+	readKey = GetenvOrDefault("RARITYMON_READ_KEY", "")
+
+	// anonymousHiddenFields are item fields, named as in the JSON, left out of the
+	// responses to requests without a key, such as "traits". Once any are set,
+	// requests without a key are let through even when a read key is configured.
+	anonymousHiddenFields = fieldSet(GetenvOrDefault("RARITYMON_ANONYMOUS_HIDDEN_FIELDS", ""))
+)
+
+func fieldSet(list string) map[string]bool {
+	fields := make(map[string]bool)
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields[field] = true
+		}
+	}
+	return fields
+}
+
+// requestKey returns the bearer token a request carries, if any
+func requestKey(c echo.Context) string {
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(auth, "Bearer ")
+}
+
+// hiddenFields returns the item fields to leave out of the response to the
+// request, nil unless it's anonymous and anonymousHiddenFields are configured
+func hiddenFields(c echo.Context) map[string]bool {
+	if len(anonymousHiddenFields) == 0 {
+		return nil
+	}
+
+	key := requestKey(c)
+	if keyMatches(key, readKey) || keyMatches(key, adminKey) {
+		return nil
+	}
+	return anonymousHiddenFields
+}
+
+func keyMatches(key, expected string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(key), []byte(expected)) == 1
+}
+
+func adminAuth() echo.MiddlewareFunc {
+	return middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+		if adminKey == "" {
+			return false, errors.New("admin endpoints are disabled")
+		}
+		return keyMatches(key, adminKey), nil
+	})
+}
+
+func readAuth() echo.MiddlewareFunc {
+	return middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+		Skipper: func(c echo.Context) bool {
+			return readKey == "" || (len(anonymousHiddenFields) > 0 && c.Request().Header.Get(echo.HeaderAuthorization) == "")
+		},
+		Validator: func(key string, c echo.Context) (bool, error) {
+			return keyMatches(key, readKey) || keyMatches(key, adminKey), nil
+		},
+	})
+}
+
+// crawlAuth additionally requires the admin role to start crawls, as long as an
+// admin key is configured
+func crawlAuth() echo.MiddlewareFunc {
+	return middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+		Skipper: func(c echo.Context) bool {
+			return adminKey == ""
+		},
+		Validator: func(key string, c echo.Context) (bool, error) {
+			return keyMatches(key, adminKey), nil
+		},
+	})
+}
+
+func registerAdminRoutes(root *echo.Group, cache Cache) {
+	admin := root.Group("/admin", adminAuth())
+
+	admin.GET("/collections", listCollectionsHandler(cache))
+	admin.GET("/maintenance", maintenanceHandler)
+	admin.PUT("/maintenance", maintenanceHandler)
+	admin.PUT("/:collection/:id", overrideHandler(cache))
+	admin.PUT("/cache/:collection/:id", overrideHandler(cache))
+	admin.DELETE("/cache/:collection", flushCollectionHandler(cache))
+	admin.DELETE("/cache/:collection/:id", evictHandler(cache))
+	admin.PUT("/cache/:collection/:id/pin", pinHandler(cache, true))
+	admin.DELETE("/cache/:collection/:id/pin", pinHandler(cache, false))
+	admin.GET("/cache/export", exportCacheHandler(cache))
+	admin.POST("/cache/import", importCacheHandler(cache), middleware.BodyLimit(importBodyLimit))
+	admin.POST("/cache/check", checkCacheHandler(cache))
+	admin.POST("/cache/reparse", reparseCacheHandler(cache))
+	admin.POST("/import-ids", importIdsHandler(cache))
+	admin.GET("/import-ids/:job", idImportStatusHandler)
+
+	debug := root.Group("/debug", adminAuth())
+	debug.GET("/key/:collection/:id", cacheKeyHandler, tokenParam)
+}
+
+type CollectionSummary struct {
+	Collection string     `json:"collection"`
+	Cached     int        `json:"cached"`
+	LastCrawl  *time.Time `json:"lastCrawl,omitempty"`
+}
+
+// listCollectionsHandler summarises every collection with cached items or metadata
+func listCollectionsHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		summaries := make(map[string]*CollectionSummary)
+		summary := func(collection string) *CollectionSummary {
+			if summaries[collection] == nil {
+				summaries[collection] = &CollectionSummary{Collection: collection}
+			}
+			return summaries[collection]
+		}
+
+		err := cache.ForEach(cacheBucket, func(k, v []byte) error {
+			if entry := decodeEntry(v); entry.Collection != "" {
+				summary(entry.Collection).Cached++
+			}
+			return nil
+		})
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		err = cache.ForEach(collectionMetaBucket, func(k, v []byte) error {
+			meta := CollectionMeta{}
+			if err := json.Unmarshal(v, &meta); err != nil {
+				return err
+			}
+			summary(string(k)).LastCrawl = meta.LastCrawl
+			return nil
+		})
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		list := make([]*CollectionSummary, 0, len(summaries))
+		for _, summary := range summaries {
+			list = append(list, summary)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Collection < list[j].Collection })
+
+		return c.JSON(http.StatusOK, list)
+	}
+}
+
+// overrideHandler stores the Item in the body as the cached value of an item,
+// pinning it against refetches with ?pin=true
+func overrideHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if readOnly {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "overrides are disabled on a read-only instance")
+		}
+
+		collection := c.Param("collection")
+		id, err := strconv.Atoi(c.Param("id"))
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		pin, _ := strconv.ParseBool(c.QueryParam("pin"))
+
+		item := &Item{}
+		decoder := json.NewDecoder(c.Request().Body)
+		decoder.DisallowUnknownFields()
+
+		if err := decoder.Decode(item); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		} else if item.Name == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "the item needs a name")
+		}
+		item.TokenID = id
+
+		encodedJson, err := json.MarshalIndent(item, " ", "  ")
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		entry := cacheEntry{Collection: collection, ID: id, Item: encodedJson, Manual: true, Pinned: pin}
+		if err := putEntry(cache, entry); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		manualOverrides.Inc()
+		if err := recordHistory(cache, entry.key(), encodedJson, true); err != nil {
+			log.Printf("history %s/%d: %v\n", collection, id, err)
+		}
+
+		return c.JSON(http.StatusOK, item)
+	}
+}
+
+// pinHandler pins or unpins a cached item, pinned items aren't replaced by
+// refreshes, the hot refresher or reparses
+func pinHandler(cache Cache, pinned bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if readOnly {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "pinning is disabled on a read-only instance")
+		}
+
+		collection := c.Param("collection")
+		id, err := strconv.Atoi(c.Param("id"))
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		entry, ok := getEntry(cache, collection, id)
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "item is not cached")
+		}
+
+		entry.Pinned = pinned
+		if err := putEntry(cache, entry); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// evictHandler removes an item from the cache. With ?tombstone= (or a configured
+// RARITYMON_TOMBSTONE_TTL) the item also isn't refetched for that long.
+func evictHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if readOnly {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "evictions are disabled on a read-only instance")
+		}
+
+		collection := c.Param("collection")
+		id, err := strconv.Atoi(c.Param("id"))
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		ttl := tombstoneTTL
+		if val := c.QueryParam("tombstone"); val != "" {
+			if ttl, err = time.ParseDuration(val); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+		}
+
+		if err := deleteCached(cache, collection, id); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		if ttl > 0 {
+			if err := putTombstone(cache, collection, id, ttl); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// flushCollectionHandler deletes every cached item of a collection
+func flushCollectionHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if readOnly {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "the cache can't be flushed on a read-only instance")
+		}
+
+		flushed, err := flushCollection(cache, c.Param("collection"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, map[string]int{"flushed": flushed})
+	}
+}
+
+// exportCacheHandler writes every cache entry as newline delimited JSON
+func exportCacheHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+		c.Response().WriteHeader(http.StatusOK)
+
+		encoder := json.NewEncoder(c.Response())
+
+		// entries are written as the cursor reaches them, apart from those whose
+		// item is in a blob, which can only be loaded once the cursor has released
+		// the cache. Entries from before the collection was stored can't be
+		// re-keyed, so they're left out.
+		var deduped [][]byte
+		err := cache.ForEach(cacheBucket, func(k, v []byte) error {
+			entry := decodeEntry(v)
+			if entry.Collection == "" {
+				return nil
+			} else if entry.Hash != "" {
+				deduped = append(deduped, append([]byte{}, k...))
+				return nil
+			}
+
+			entry, err := resolveEntry(cache, entry)
+			if err != nil {
+				return err
+			}
+			return encoder.Encode(entry)
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, key := range deduped {
+			if entry, ok := getEntryByKey(cache, key); ok {
+				if err := encoder.Encode(entry); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// checkDumpEntry reports what's wrong with an entry of a dump, if anything. Its
+// collection has to be usable in a path and it needs either a positive id or a
+// token, matching the ones of its item. Items cached before they recorded their
+// id have none to match.
+func checkDumpEntry(entry cacheEntry) error {
+	if entry.Collection == "" || entry.Item == nil {
+		return errors.New("dump entries need a collection, id and item")
+	} else if len(entry.Collection) > maxTokenLength || strings.ContainsAny(entry.Collection, "/?#%") ||
+		strings.IndexFunc(entry.Collection, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return fmt.Errorf("malformed collection %q", entry.Collection)
+	}
+
+	item := &Item{}
+	if err := json.Unmarshal(entry.Item, item); err != nil {
+		return err
+	}
+
+	if entry.Token != "" {
+		if entry.ID != 0 || len(entry.Token) > maxTokenLength {
+			return fmt.Errorf("malformed token %q of %s", entry.Token, entry.Collection)
+		} else if item.Token != entry.Token {
+			return fmt.Errorf("token %q of %s doesn't match its item's %q", entry.Token, entry.Collection, item.Token)
+		}
+	} else if entry.ID <= 0 {
+		return fmt.Errorf("malformed id %d of %s", entry.ID, entry.Collection)
+	} else if item.TokenID != 0 && item.TokenID != entry.ID {
+		return fmt.Errorf("id %d of %s doesn't match its item's %d", entry.ID, entry.Collection, item.TokenID)
+	}
+	return nil
+}
+
+// importCacheHandler loads a dump produced by exportCacheHandler into the cache,
+// stopping at the first malformed entry
+func importCacheHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if readOnly {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "imports are disabled on a read-only instance")
+		}
+
+		imported := 0
+		decoder := json.NewDecoder(c.Request().Body)
+
+		for {
+			entry := cacheEntry{}
+			if err := decoder.Decode(&entry); err == io.EOF {
+				break
+			} else if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+
+			if err := checkDumpEntry(entry); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("entry %d: %v, %d imported before it", imported+1, err, imported))
+			}
+
+			if err := putEntry(cache, entry); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+			imported++
+		}
+
+		return c.JSON(http.StatusOK, map[string]int{"imported": imported})
+	}
+}
+
+type CacheCheck struct {
+	Checked int `json:"checked"`
+	OK      int `json:"ok"`
+	Failed  int `json:"failed"`
+	Removed int `json:"removed"`
+}
+
+// checkCacheHandler decodes every cached item, deleting the ones that fail to
+// decode when ?repair=true
+func checkCacheHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		repair, _ := strconv.ParseBool(c.QueryParam("repair"))
+
+		if repair && readOnly {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "repairs are disabled on a read-only instance")
+		}
+
+		entries := make(map[string]cacheEntry)
+		err := cache.ForEach(cacheBucket, func(k, v []byte) error {
+			entries[string(k)] = decodeEntry(v)
+			return nil
+		})
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		check := CacheCheck{}
+		for key, entry := range entries {
+			check.Checked++
+
+			entry, err := resolveEntry(cache, entry)
+			if err == nil {
+				err = json.Unmarshal(entry.Item, &Item{})
+			}
+
+			if err == nil {
+				check.OK++
+				continue
+			}
+			check.Failed++
+
+			if !repair {
+				continue
+			}
+
+			if err := deleteEntry(cache, []byte(key)); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+			check.Removed++
+		}
+
+		return c.JSON(http.StatusOK, check)
+	}
+}
+
+type CacheReparse struct {
+	Reparsed int `json:"reparsed"`
+	Failed   int `json:"failed"`
+	NoPage   int `json:"noPage"`
+}
+
+// reparseCacheHandler parses the stored page of every cached item again and
+// replaces the cached item with the result, without any upstream requests
+func reparseCacheHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if readOnly {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "reparsing is disabled on a read-only instance")
+		}
+
+		entries := make(map[string]cacheEntry)
+		err := cache.ForEach(cacheBucket, func(k, v []byte) error {
+			// pinned and manually set items are left as they are
+			if entry := decodeEntry(v); entry.Collection != "" && !entry.Pinned && !entry.Manual {
+				entries[string(k)] = entry
+			}
+			return nil
+		})
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		reparse := CacheReparse{}
+		for key, entry := range entries {
+			page, err := cache.Get(pageBucket, []byte(key))
+
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			} else if page == nil {
+				reparse.NoPage++
+				continue
+			}
+
+			item, err := ParseItem(string(page))
+			if err == nil {
+				item.TokenID, item.Token = entry.ID, entry.Token
+				entry.ParseWarnings = item.ParseWarnings
+				entry.Item, err = json.MarshalIndent(item, " ", "  ")
+			}
+
+			if err != nil {
+				log.Printf("reparse %s/%d: %v\n", entry.Collection, entry.ID, err)
+				reparse.Failed++
+				continue
+			}
+
+			entry.Hash = ""
+			if err := putEntry(cache, entry); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+			reparse.Reparsed++
+		}
+
+		return c.JSON(http.StatusOK, reparse)
+	}
+}
+
+type CacheKey struct {
+	Key       string `json:"key"`
+	Namespace string `json:"namespace"`
+
+	// Collection, ID and ParserVersion are what the key is hashed from, the
+	// parser version salting both hashes when it's set
+	Collection    string `json:"collection"`
+	ID            string `json:"id"`
+	ParserVersion string `json:"parserVersion"`
+}
+
+// cacheKeyHandler reports the key an item is stored under in every bucket, along
+// with the prefix shared by every key of its collection and what they're hashed
+// from. Ids are read as the token route reads them, so plain numbers are keyed
+// as numeric ids and anything else, "03" included, as it is.
+func cacheKeyHandler(c echo.Context) error {
+	requested, err := requestedEntry(c)
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	id := requested.Token
+	if id == "" {
+		id = strconv.Itoa(requested.ID)
+	}
+
+	return c.JSON(http.StatusOK, CacheKey{
+		Key:           hex.EncodeToString(requested.key()),
+		Namespace:     hex.EncodeToString(collectionNamespace(requested.Collection)),
+		Collection:    requested.Collection,
+		ID:            id,
+		ParserVersion: parserVersion,
+	})
+}
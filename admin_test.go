@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestImportCacheTokenID(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       int
+		dump     string
+		wantCode int
+	}{
+		// items cached before they recorded the id they were requested by
+		{
+			"no tokenId",
+			1,
+			`{"collection":"foo","id":1,"item":{"name":"Test #1","rank":1,"total":10,"score":1,"traits":{}}}`,
+			http.StatusOK,
+		},
+		{
+			"matching tokenId",
+			2,
+			`{"collection":"foo","id":2,"item":{"tokenId":2,"name":"Test #2","rank":2,"total":10,"score":1,"traits":{}}}`,
+			http.StatusOK,
+		},
+		{
+			"other tokenId",
+			3,
+			`{"collection":"foo","id":3,"item":{"tokenId":4,"name":"Test #4","rank":4,"total":10,"score":1,"traits":{}}}`,
+			http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		cache := newMemoryCache()
+		e := echo.New()
+		e.HTTPErrorHandler = handleError
+		e.POST("/admin/cache/import", importCacheHandler(cache))
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/cache/import", strings.NewReader(test.dump+"\n")))
+
+		if rec.Code != test.wantCode {
+			t.Errorf("%s: the import answered %d %s, want %d", test.name, rec.Code, rec.Body, test.wantCode)
+		}
+		if _, cached := getEntry(cache, "foo", test.id); cached != (test.wantCode == http.StatusOK) {
+			t.Errorf("%s: the entry was cached %t after the import", test.name, cached)
+		}
+	}
+}
@@ -2,156 +2,596 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/json"
+	"context"
+	"encoding/xml"
 	"errors"
 	"fmt"
-	"log"
+	"math"
 	"net/http"
-	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/anaskhan96/soup"
-	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
-	bolt "go.etcd.io/bbolt"
 )
 
 var (
-	traitMatcher       = regexp.MustCompile(`([\w\s_-]+):\s([\w\s_-]+)`)
-	rankMatcher        = regexp.MustCompile(`Rank\s([0-9]+)\s\/\s([0-9]+)`)
-	rarityScoreMatcher = regexp.MustCompile(`Rarity\sScore:\s([0-9\.]+)`)
+	traitMatcher       = regexp.MustCompile(`(?s)^(.+?):\s+(.+)$`)
+	rankMatcher        = regexp.MustCompile(`Rank\s([0-9,]+)\s\/\s([0-9,]+)`)
+	rarityScoreMatcher = regexp.MustCompile(`Rarity\sScore:\s([0-9\.,]+)`)
+	supplyMatcher      = regexp.MustCompile(`(?i)Supply:?\s([0-9,]+)`)
+	contractMatcher    = regexp.MustCompile(`0x[0-9a-fA-F]{40}`)
+	numberSignMatcher  = regexp.MustCompile(`#+\s*`)
+	fractionMatcher    = regexp.MustCompile(`^([0-9,]+)\s*\/\s*([0-9,]+)$`)
+	scoreNumberMatcher = regexp.MustCompile(`[0-9][0-9.,]*`)
 
 	ErrorNodeNotFound       = errors.New("could not find the HTML node")
 	ErrorNodeLengthMismatch = errors.New("rarity nodes found are unbalanced")
+	ErrorUpstreamStatus     = errors.New("RarityMon responded with an unexpected status")
+	ErrorPageTruncated      = errors.New("page appears to be truncated, not every trait was rendered")
+	ErrorUpstreamRedirect   = errors.New("RarityMon redirected unexpectedly")
+	ErrorCollectionNotFound = errors.New("collection not found")
+	ErrorItemNotFound       = errors.New("item not found")
+	ErrorParsePanic         = errors.New("parsing the page panicked")
 )
 
-const RarityMonURL = "https://www.raritymon.com/Item-details?collection=%s&id=%d"
+// lenient makes ParseItem return partially populated items instead of failing
+// when the rank, score or trait nodes are missing
+var lenient = GetenvBoolOrDefault("RARITYMON_LENIENT", false)
+
+var (
+	// rawNames turns off the normalization of scraped item names
+	rawNames = GetenvBoolOrDefault("RARITYMON_RAW_NAMES", false)
+
+	// namePrefix is stripped from the start of normalized item names
+	namePrefix = GetenvOrDefault("RARITYMON_NAME_PREFIX", "")
+)
+
+var (
+	// statRaritySelector and normalizedScoreSelector locate the additional scores
+	// some pages show, as tag.class. An empty selector skips the score.
+	statRaritySelector      = GetenvOrDefault("RARITYMON_STAT_RARITY_SELECTOR", "button.item-statistical-rarity")
+	normalizedScoreSelector = GetenvOrDefault("RARITYMON_NORMALIZED_SCORE_SELECTOR", "button.item-normalized-score")
+
+	// supplySelector locates the collection supply some item pages show, as tag.class
+	supplySelector = GetenvOrDefault("RARITYMON_SUPPLY_SELECTOR", "div.item-supply")
+
+	// itemTierSelector locates the tier label of the item as a whole, such as
+	// "Top 1%", as tag.class. When it shares the class of the trait tiers, the
+	// first node of that class is taken as the item's and left out of them.
+	itemTierSelector = GetenvOrDefault("RARITYMON_ITEM_TIER_SELECTOR", "div.item-tier")
+)
+
+var (
+	// truncationMarkers are the snippets of a page that mean RarityMon paginated or
+	// lazy-loaded its traits, so the page doesn't hold all of them
+	truncationMarkers = strings.Split(GetenvOrDefault("RARITYMON_TRUNCATION_MARKERS", "load-more,Load more"), ",")
+
+	// truncatedPages is what happens to the items of truncated pages, "warn" keeps
+	// them with a warning and "reject" fails the fetch
+	truncatedPages = GetenvOrDefault("RARITYMON_TRUNCATED_PAGES", "warn")
+
+	// maxTraits is the most traits parsed per item, guarding against pathological pages
+	maxTraits = GetenvIntOrDefault("RARITYMON_MAX_TRAITS", 500)
+)
+
+// collectionMissingMarkers are the snippets of the page RarityMon serves for an
+// unknown collection slug, which would otherwise parse into an odd item
+var collectionMissingMarkers = strings.Split(GetenvOrDefault("RARITYMON_COLLECTION_NOT_FOUND_MARKERS", "Collection not found"), ",")
+
+// itemMissingMarkers are the snippets of the page RarityMon serves for an id the
+// collection doesn't have, the one result the negative cache remembers
+var itemMissingMarkers = strings.Split(GetenvOrDefault("RARITYMON_ITEM_NOT_FOUND_MARKERS", "Item not found"), ",")
+
+// containsAny reports whether page contains one of markers
+func containsAny(page string, markers []string) bool {
+	for _, marker := range markers {
+		if marker != "" && strings.Contains(page, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// upstreamTimeout bounds every request to RarityMon whose context doesn't
+	// carry a deadline already. Callers may ask for up to maxUpstreamTimeout.
+	upstreamTimeout    = GetenvDurationOrDefault("RARITYMON_UPSTREAM_TIMEOUT", 15*time.Second)
+	maxUpstreamTimeout = GetenvDurationOrDefault("RARITYMON_MAX_UPSTREAM_TIMEOUT", 2*time.Minute)
+
+	// maxRedirects is how many redirects a fetch follows. Redirects to hosts other
+	// than the one requested or one of redirectHosts are never followed.
+	maxRedirects  = GetenvIntOrDefault("RARITYMON_MAX_REDIRECTS", 3)
+	redirectHosts = strings.Split(GetenvOrDefault("RARITYMON_REDIRECT_HOSTS", ""), ",")
+)
+
+const (
+	RarityMonURL           = "https://www.raritymon.com/Item-details?collection=%s&id=%d"
+	RarityMonCollectionURL = "https://www.raritymon.com/Collection-details?collection=%s"
+
+	// RarityMonTokenURL takes the query escaped string id of an item
+	RarityMonTokenURL = "https://www.raritymon.com/Item-details?collection=%s&id=%s"
+)
 
 type Item struct {
-	Name   string           `json:"name"`
-	Rank   int              `json:"rank"`
-	Total  int              `json:"total"`
-	Score  float64          `json:"score"`
-	Traits map[string]Trait `json:"traits"`
+	// TokenID is the id the item was requested by, which the number in its name
+	// doesn't always match
+	TokenID int `json:"tokenId,omitempty" xml:"tokenId,omitempty"`
+
+	// Token is the id of items of collections whose ids aren't numbers
+	Token string `json:"token,omitempty" xml:"token,omitempty"`
+
+	Name   string   `json:"name" xml:"name"`
+	Rank   int      `json:"rank" xml:"rank"`
+	Total  int      `json:"total" xml:"total"`
+	Score  float64  `json:"score" xml:"score"`
+	Traits TraitMap `json:"traits" xml:"traits,omitempty"`
+
+	// RankedTotal is the number of items RarityMon ranks, the same as Total which
+	// keeps that meaning. Supply is the collection's supply when the page shows
+	// it, above RankedTotal while a collection is still being ranked.
+	RankedTotal int `json:"rankedTotal,omitempty" xml:"rankedTotal,omitempty"`
+	Supply      int `json:"supply,omitempty" xml:"supply,omitempty"`
+
+	// ItemTier is the tier label RarityMon gives the whole item, apart from the
+	// tiers of its traits, empty when the page shows none
+	ItemTier string `json:"itemTier,omitempty" xml:"itemTier,omitempty"`
+
+	// StatRarity and TraitNormalizedScore are the additional scores some pages
+	// show next to the rarity score, left at zero when a page doesn't
+	StatRarity           float64 `json:"statRarity,omitempty" xml:"statRarity,omitempty"`
+	TraitNormalizedScore float64 `json:"traitNormalizedScore,omitempty" xml:"traitNormalizedScore,omitempty"`
+
+	// Warnings lists the data that couldn't be extracted when running in lenient mode,
+	// and pages that appear truncated
+	Warnings []string `json:"warnings,omitempty" xml:"warning,omitempty"`
+
+	// ParseWarnings are oddities that didn't stop the parse, like a trait that
+	// didn't match the expected form. They're stored next to the item and served
+	// in the X-Raritymon-Warnings header rather than the body.
+	ParseWarnings []string `json:"-" xml:"-"`
 }
 
 type Trait struct {
-	Type       string  `json:"type"`
-	Name       string  `json:"name"`
-	Tier       string  `json:"tier"`
-	Percentage float64 `json:"percentage"`
+	Type       string  `json:"type" xml:"type"`
+	Name       string  `json:"name" xml:"name"`
+	Tier       string  `json:"tier" xml:"tier"`
+	Percentage float64 `json:"percentage" xml:"percentage"`
+
+	// BasisPoints is Percentage in hundredths of a percent, only set when asked for
+	BasisPoints *int `json:"basisPoints,omitempty" xml:"basisPoints,omitempty"`
+}
+
+// TraitMap holds an item's traits keyed by their type
+type TraitMap map[string]Trait
+
+// MarshalXML writes the traits as a list of trait elements, ordered by type
+func (t TraitMap) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	keys := make([]string, 0, len(t))
+	for key := range t {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := e.EncodeElement(t[key], xml.StartElement{Name: xml.Name{Local: "trait"}}); err != nil {
+			return err
+		}
+	}
+
+	return e.EncodeToken(start.End())
+}
+
+// CollectionInfo holds the collection wide data shown on a collection page
+type CollectionInfo struct {
+	Name     string    `json:"name" xml:"name"`
+	Supply   int       `json:"supply" xml:"supply"`
+	Contract string    `json:"contract,omitempty" xml:"contract,omitempty"`
+	Fetched  time.Time `json:"fetched" xml:"fetched"`
+}
+
+// nodeText returns the value of the first child of a node, which is the text of
+// elements holding just text, or "" when the node is empty
+func nodeText(node soup.Root) string {
+	if children := node.Children(); len(children) > 0 {
+		return children[0].NodeValue
+	}
+	return ""
 }
 
 func checkNode(node *soup.Root) error {
 	if node.Error != nil {
-		return node.Error
+		return fmt.Errorf("%w: %v", ErrorNodeNotFound, node.Error)
 	} else if node.Pointer == nil {
 		return ErrorNodeNotFound
 	}
 	return nil
 }
 
+// normalizeName trims and collapses the whitespace in a scraped item name, turns
+// runs of "#" followed by spaces into a single "#" and strips namePrefix
+func normalizeName(name string) string {
+	if rawNames {
+		return name
+	}
+
+	name = strings.Join(strings.Fields(name), " ")
+	name = numberSignMatcher.ReplaceAllString(name, "#")
+
+	if namePrefix != "" {
+		name = strings.TrimSpace(strings.TrimPrefix(name, namePrefix))
+	}
+	return name
+}
+
+// stripThousands removes thousands separators so "1,234" can be handed to strconv
+func stripThousands(num string) string {
+	return strings.ReplaceAll(num, ",", "")
+}
+
 func parseRank(rank string) (int, int) {
 	rank = strings.TrimSpace(rank)
 
 	if rankMatcher.MatchString(rank) {
 		groups := rankMatcher.FindAllStringSubmatch(rank, -1)
-		ranking, _ := strconv.Atoi(groups[0][1])
-		total, _ := strconv.Atoi(groups[0][2])
+		ranking, rankErr := strconv.Atoi(stripThousands(groups[0][1]))
+		total, totalErr := strconv.Atoi(stripThousands(groups[0][2]))
 
-		return ranking, total
+		// the groups can hold nothing but separators, or overflow an int
+		if rankErr == nil && totalErr == nil {
+			return ranking, total
+		}
 	}
 
 	return -1, -1
 }
 
+// normalizeDecimal rewrites a number using either "." or "," as its decimal
+// separator into the form strconv expects. Trailing separators, such as the
+// comma of "123.45,", are punctuation and dropped. When both appear the last one
+// is the decimal separator. A lone "," is only a thousands separator when it
+// sits between a group of one to three digits not starting with 0 and exactly
+// three digits, so "1,234" reads as a thousand and "0,125" as an eighth.
+func normalizeDecimal(num string) string {
+	num = strings.TrimRight(num, ".,")
+	comma, dot := strings.LastIndex(num, ","), strings.LastIndex(num, ".")
+
+	switch {
+	case comma >= 0 && dot >= 0:
+		if comma > dot {
+			return strings.ReplaceAll(strings.ReplaceAll(num, ".", ""), ",", ".")
+		}
+		return stripThousands(num)
+	case comma >= 0:
+		if strings.Count(num, ",") == 1 && !thousandsGroup(num[:comma], num[comma+1:]) {
+			return strings.Replace(num, ",", ".", 1)
+		}
+		return stripThousands(num)
+	case strings.Count(num, ".") > 1:
+		return strings.ReplaceAll(num, ".", "")
+	}
+	return num
+}
+
+// thousandsGroup reports whether a "," between whole and rest can be a
+// thousands separator
+func thousandsGroup(whole, rest string) bool {
+	return len(rest) == 3 && len(whole) >= 1 && len(whole) <= 3 && whole[0] != '0'
+}
+
 func parseRarity(rarity string) float64 {
 	rarity = strings.TrimSpace(rarity)
 
 	if rarityScoreMatcher.MatchString(rarity) {
 		groups := rarityScoreMatcher.FindAllStringSubmatch(rarity, -1)
-		rarity, _ := strconv.ParseFloat(groups[0][1], 64)
-		return rarity
+		rarity, err := strconv.ParseFloat(normalizeDecimal(groups[0][1]), 64)
+		if err == nil {
+			return rarity
+		}
 	}
 
 	return -1
 }
 
+// findNode returns the first node matching a tag.class selector, with an Error
+// when there's none or the selector is empty
+func findNode(root soup.Root, selector string) soup.Root {
+	tag, class, _ := strings.Cut(selector, ".")
+	if tag == "" {
+		return soup.Root{Error: ErrorNodeNotFound}
+	}
+	return findFirst(root, tag, class)
+}
+
+// withoutNode returns nodes without the one skip points at
+func withoutNode(nodes []soup.Root, skip soup.Root) []soup.Root {
+	if skip.Pointer == nil {
+		return nodes
+	}
+
+	kept := make([]soup.Root, 0, len(nodes))
+	for _, node := range nodes {
+		if node.Pointer != skip.Pointer {
+			kept = append(kept, node)
+		}
+	}
+	return kept
+}
+
+// findScore reads the first number inside the node matching a tag.class
+// selector, returning 0 when there's no such node or number
+func findScore(root soup.Root, selector string) float64 {
+	node := findNode(root, selector)
+	if node.Error != nil {
+		return 0
+	}
+
+	score, err := strconv.ParseFloat(normalizeDecimal(scoreNumberMatcher.FindString(node.FullText())), 64)
+	if err != nil {
+		return 0
+	}
+	return score
+}
+
 func parseTraitEntry(trait string) (string, string) {
 	trait = strings.TrimSpace(trait)
 
 	if traitMatcher.MatchString(trait) {
 		groups := traitMatcher.FindAllStringSubmatch(trait, -1)
-		return groups[0][1], groups[0][2]
+		return strings.TrimSpace(groups[0][1]), groups[0][2]
 	}
 
 	return "", ""
 }
 
+// parsePercentage reads a trait rarity, given either as a percentage or as a
+// count of the collection such as "12 / 1000"
 func parsePercentage(percentage string) float64 {
-	percentage = strings.TrimSpace(strings.ReplaceAll(percentage, "%", ""))
-	num, _ := strconv.ParseFloat(percentage, 64)
+	if groups := fractionMatcher.FindStringSubmatch(strings.TrimSpace(percentage)); groups != nil {
+		count, countErr := strconv.ParseFloat(stripThousands(groups[1]), 64)
+		total, totalErr := strconv.ParseFloat(stripThousands(groups[2]), 64)
+
+		// the groups can hold nothing but separators, or overflow a float
+		if countErr != nil || totalErr != nil || total == 0 {
+			return 0
+		}
+		return 100 * count / total
+	}
+
+	percentage = normalizeDecimal(strings.TrimSpace(strings.ReplaceAll(percentage, "%", "")))
+	num, err := strconv.ParseFloat(percentage, 64)
+
+	// ParseFloat also accepts "NaN" and "Inf", neither of which is a percentage
+	if err != nil || math.IsNaN(num) || math.IsInf(num, 0) {
+		return 0
+	}
 	return num
 }
 
-func FetchItem(collectionId string, id int) (*Item, error) {
-	resp, err := soup.Get(fmt.Sprintf(RarityMonURL, collectionId, id))
+// FetchPage downloads the raw HTML of an item page
+func FetchPage(ctx context.Context, collectionId string, id int) (string, error) {
+	return getPage(ctx, fmt.Sprintf(RarityMonURL, collectionId, id))
+}
 
-	if err != nil {
-		return nil, err
+// contextTransport ties every request made through it to ctx, soup has no way
+// of passing a context along itself. It also remembers the last status code
+// since soup doesn't look at it, and why a redirect was refused since soup
+// replaces the error with its own.
+type contextTransport struct {
+	ctx         context.Context
+	status      int
+	redirectErr error
+}
+
+func (t *contextTransport) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > maxRedirects {
+		t.redirectErr = fmt.Errorf("%w: more than %d redirects", ErrorUpstreamRedirect, maxRedirects)
+		return t.redirectErr
+	}
+	if err := spendUpstreamCall(t.ctx); err != nil {
+		t.redirectErr = err
+		return err
 	}
 
-	rootNode := soup.HTMLParse(resp)
+	if host := req.URL.Hostname(); host != via[0].URL.Hostname() {
+		for _, allowed := range redirectHosts {
+			if host == strings.TrimSpace(allowed) {
+				return nil
+			}
+		}
+		t.redirectErr = fmt.Errorf("%w to %s", ErrorUpstreamRedirect, req.URL)
+		return t.redirectErr
+	}
+	return nil
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req.WithContext(t.ctx))
+	if err == nil {
+		t.status = resp.StatusCode
+		noteRetryAfter(resp)
+	}
+	return resp, err
+}
+
+// getPage downloads url, giving up after upstreamTimeout unless ctx has a deadline.
+// It fails straight away while RarityMon has asked for a backoff.
+func getPage(ctx context.Context, url string) (string, error) {
+	if backoffRemaining() > 0 {
+		return "", ErrorUpstreamBackoff
+	}
+	if err := spendUpstreamCall(ctx); err != nil {
+		fetchFailures.Inc("upstream_budget")
+		return "", err
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, upstreamTimeout)
+		defer cancel()
+	}
+
+	transport := &contextTransport{ctx: ctx}
+	page, err := soup.GetWithClient(url, &http.Client{Transport: transport, CheckRedirect: transport.checkRedirect})
+
+	if err != nil && errors.Is(transport.redirectErr, ErrorUpstreamBudget) {
+		fetchFailures.Inc("upstream_budget")
+		return "", transport.redirectErr
+	} else if err != nil && transport.redirectErr != nil {
+		fetchFailures.Inc("upstream_redirect")
+		return "", transport.redirectErr
+	} else if err != nil && ctx.Err() != nil {
+		// soup's own error doesn't say why the request failed
+		if ctx.Err() == context.DeadlineExceeded {
+			fetchFailures.Inc("upstream_timeout")
+		}
+		return "", ctx.Err()
+	} else if err != nil {
+		fetchFailures.Inc("upstream_error")
+		return "", err
+	}
+
+	if transport.status != http.StatusOK {
+		fetchFailures.Inc("upstream_status")
+		return "", fmt.Errorf("%w %d", ErrorUpstreamStatus, transport.status)
+	}
+	return page, nil
+}
+
+// recoverParse turns a panic while parsing into an ErrorParsePanic, soup panics
+// on some malformed HTML. It must be deferred.
+func recoverParse(err *error) {
+	if r := recover(); r != nil {
+		fetchFailures.Inc("parse_panic")
+		*err = fmt.Errorf("%w: %v", ErrorParsePanic, r)
+	}
+}
+
+// ParseItem extracts an item from the HTML of its page
+func ParseItem(page string) (item *Item, err error) {
+	defer recoverParse(&err)
+
+	rootNode := parseHTML(page)
 
 	if err := checkNode(&rootNode); err != nil {
+		fetchFailures.Inc("page_invalid")
 		return nil, err
 	}
 
-	itemName := rootNode.Find("h2")
+	if containsAny(page, collectionMissingMarkers) {
+		fetchFailures.Inc("collection_not_found")
+		return nil, ErrorCollectionNotFound
+	}
+
+	if containsAny(page, itemMissingMarkers) {
+		fetchFailures.Inc("item_not_found")
+		return nil, ErrorItemNotFound
+	}
+
+	itemName := findFirst(rootNode, "h2", "")
 
 	if err := checkNode(&itemName); err != nil {
+		fetchFailures.Inc("name_missing")
 		return nil, err
 	}
 
-	rarityRank := rootNode.Find("button", "class", "item-rarity-rank")
+	item = &Item{
+		Name:   normalizeName(nodeText(itemName)),
+		Rank:   -1,
+		Total:  -1,
+		Score:  -1,
+		Traits: make(TraitMap),
+	}
+
+	if containsAny(page, truncationMarkers) {
+		fetchFailures.Inc("page_truncated")
+		if truncatedPages == "reject" {
+			return nil, ErrorPageTruncated
+		}
+		item.Warnings = append(item.Warnings, "traits: "+ErrorPageTruncated.Error())
+	}
+
+	rarityRank := findFirst(rootNode, "button", "item-rarity-rank")
 
 	if err := checkNode(&rarityRank); err != nil {
-		return nil, err
+		fetchFailures.Inc("rank_missing")
+		if !lenient {
+			return nil, err
+		}
+		item.Warnings = append(item.Warnings, "rank: "+err.Error())
+	} else {
+		text := nodeText(rarityRank)
+		if item.Rank, item.Total = parseRank(text); item.Rank == -1 {
+			item.ParseWarnings = append(item.ParseWarnings, fmt.Sprintf("rank %q not recognized", strings.TrimSpace(text)))
+		} else {
+			item.RankedTotal = item.Total
+		}
 	}
-	rarityScore := rootNode.Find("button", "class", "item-trait-data")
+
+	rarityScore := findFirst(rootNode, "button", "item-trait-data")
 
 	if err := checkNode(&rarityScore); err != nil {
-		return nil, err
+		fetchFailures.Inc("score_missing")
+		if !lenient {
+			return nil, err
+		}
+		item.Warnings = append(item.Warnings, "score: "+err.Error())
+	} else {
+		text := nodeText(rarityScore)
+		if item.Score = parseRarity(text); item.Score == -1 {
+			item.ParseWarnings = append(item.ParseWarnings, fmt.Sprintf("score %q not recognized", strings.TrimSpace(text)))
+		}
 	}
 
-	traitTitles := rootNode.FindAll("h3", "class", "tier-title")
-	traitRarityPercentages := rootNode.FindAll("div", "class", "item-rarity-percentage")
-	traitRarityTiers := rootNode.FindAll("div", "class", "item-rarity-tier")
+	item.StatRarity = findScore(rootNode, statRaritySelector)
+	item.TraitNormalizedScore = findScore(rootNode, normalizedScoreSelector)
+
+	// a supply too large for an int can only come from a garbled page
+	if supply := findScore(rootNode, supplySelector); supply < math.MaxInt32 {
+		item.Supply = int(supply)
+	}
+
+	itemTier := findNode(rootNode, itemTierSelector)
+	if itemTier.Error == nil {
+		item.ItemTier = strings.Join(strings.Fields(itemTier.FullText()), " ")
+	}
+
+	traitTitles := findEvery(rootNode, "h3", "tier-title")
+	traitRarityPercentages := findEvery(rootNode, "div", "item-rarity-percentage")
+	traitRarityTiers := withoutNode(findEvery(rootNode, "div", "item-rarity-tier"), itemTier)
 
 	balanced := len(traitTitles) == len(traitRarityPercentages) && len(traitRarityPercentages) == len(traitRarityTiers)
 
 	if !balanced {
-		return nil, ErrorNodeLengthMismatch
+		fetchFailures.Inc("unbalanced_traits")
+		if !lenient {
+			return nil, ErrorNodeLengthMismatch
+		}
+		// the nodes can't be paired up reliably, so don't guess at any of the traits
+		item.Warnings = append(item.Warnings, "traits: "+ErrorNodeLengthMismatch.Error())
+		return item, nil
 	}
 
-	ranking, total := parseRank(rarityRank.Children()[0].NodeValue)
-	rarityScoreVal := parseRarity(rarityScore.Children()[0].NodeValue)
-
-	item := &Item{
-		Name:   itemName.Children()[0].NodeValue,
-		Rank:   ranking,
-		Total:  total,
-		Score:  rarityScoreVal,
-		Traits: make(map[string]Trait),
+	if maxTraits > 0 && len(traitTitles) > maxTraits {
+		item.Warnings = append(item.Warnings, fmt.Sprintf("traits: only the first %d of %d traits were kept", maxTraits, len(traitTitles)))
+		traitTitles = traitTitles[:maxTraits]
 	}
 
 	for i, traitTitle := range traitTitles {
-		traitKey, traitValue := parseTraitEntry(traitTitle.Children()[0].NodeValue)
-		traitRarityPercentage := parsePercentage(traitRarityPercentages[i].Children()[0].NodeValue)
-		traitRarityTier := traitRarityTiers[i].Children()[0].NodeValue
+		traitKey, traitValue := parseTraitEntry(nodeText(traitTitle))
+		if traitKey == "" {
+			item.ParseWarnings = append(item.ParseWarnings, fmt.Sprintf("trait %q not recognized", strings.TrimSpace(nodeText(traitTitle))))
+		} else if _, ok := item.Traits[traitKey]; ok {
+			item.ParseWarnings = append(item.ParseWarnings, fmt.Sprintf("trait %q repeated", traitKey))
+		}
+		traitRarityPercentage := parsePercentage(nodeText(traitRarityPercentages[i]))
+		traitRarityTier := nodeText(traitRarityTiers[i])
 
 		item.Traits[traitKey] = Trait{
 			Type:       traitKey,
@@ -164,91 +604,70 @@ func FetchItem(collectionId string, id int) (*Item, error) {
 	return item, nil
 }
 
-func GetenvOrDefault(key, def string) string {
-	val, ok := os.LookupEnv(key)
-	if !ok {
-		return def
-	}
-	return val
-}
+// ParseRank extracts only the rank and total from the HTML of an item page,
+// without looking at the rest of the page
+func ParseRank(page string) (rank int, total int, err error) {
+	defer recoverParse(&err)
 
-func quickHash(s string) []byte {
-	hash := sha256.New()
-	hash.Write([]byte(s))
-	return hash.Sum(nil)
-}
+	rootNode := parseHTML(page)
 
-func main() {
-	db, err := bolt.Open(GetenvOrDefault("RARITYMON_DB_PATH", "raritymon.db"), 0666, nil)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	defer db.Close()
-
-	cacheMiddleware := func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(c echo.Context) error {
-			collection := c.Param("collection")
-			id := c.Param("id")
-
-			hash := quickHash(collection + ":" + id)
-
-			jsonReturn := []byte{}
-			db.View(func(tx *bolt.Tx) error {
-				bucket := tx.Bucket([]byte("RarityCache"))
-				if bucket != nil {
-					cachedJson := bucket.Get(hash)
-					if cachedJson != nil {
-						jsonReturn = cachedJson
-					}
-				}
-				return nil
-			})
+	if err := checkNode(&rootNode); err != nil {
+		return -1, -1, err
+	} else if containsAny(page, collectionMissingMarkers) {
+		return -1, -1, ErrorCollectionNotFound
+	} else if containsAny(page, itemMissingMarkers) {
+		return -1, -1, ErrorItemNotFound
+	}
 
-			if len(jsonReturn) > 0 {
-				return c.JSONBlob(http.StatusOK, jsonReturn)
-			}
-			return next(c)
-		}
+	rarityRank := findFirst(rootNode, "button", "item-rarity-rank")
+
+	if err := checkNode(&rarityRank); err != nil {
+		return -1, -1, err
 	}
 
-	e := echo.New()
+	rank, total = parseRank(nodeText(rarityRank))
+	return rank, total, nil
+}
 
-	e.Use(middleware.CORS())
-	e.GET("/api/:collection/:id", func(c echo.Context) error {
-		collection := c.Param("collection")
-		id, err := strconv.Atoi(c.Param("id"))
+// FetchCollectionInfo downloads and parses a collection page
+func FetchCollectionInfo(ctx context.Context, collectionId string) (*CollectionInfo, error) {
+	release, err := acquireSlots(ctx, collectionId)
+	if err != nil {
+		return nil, err
+	}
+	page, err := getPage(ctx, fmt.Sprintf(RarityMonCollectionURL, collectionId))
+	release()
 
-		if err != nil {
-			return c.String(http.StatusBadRequest, err.Error())
-		}
+	if err != nil {
+		return nil, err
+	} else if containsAny(page, collectionMissingMarkers) {
+		return nil, ErrorCollectionNotFound
+	}
 
-		item, err := FetchItem(collection, id)
+	rootNode := parseHTML(page)
 
-		if err != nil {
-			return c.String(http.StatusInternalServerError, err.Error())
-		}
+	if err := checkNode(&rootNode); err != nil {
+		return nil, err
+	}
 
-		encodedJson, err := json.MarshalIndent(item, " ", "  ")
+	collectionName := findFirst(rootNode, "h2", "")
 
-		if err != nil {
-			return c.String(http.StatusInternalServerError, err.Error())
-		}
+	if err := checkNode(&collectionName); err != nil {
+		return nil, err
+	}
 
-		err = db.Update(func(tx *bolt.Tx) error {
-			bucket, err := tx.CreateBucketIfNotExists([]byte("RarityCache"))
+	info := &CollectionInfo{
+		Name:    strings.TrimSpace(collectionName.FullText()),
+		Fetched: time.Now().UTC(),
+	}
 
-			if err != nil {
-				return err
-			}
+	text := rootNode.FullText()
 
-			return bucket.Put(quickHash(collection+":"+c.Param("id")), encodedJson)
-		})
+	if groups := supplyMatcher.FindStringSubmatch(text); groups != nil {
+		info.Supply, _ = strconv.Atoi(stripThousands(groups[1]))
+	}
 
-		if err != nil {
-			return c.String(http.StatusInternalServerError, err.Error())
-		}
+	info.Contract = contractMatcher.FindString(text)
 
-		return c.JSONBlob(http.StatusOK, encodedJson)
-	}, cacheMiddleware)
-	e.Start(GetenvOrDefault("RARITYMON_WEB_HOST", ":1337"))
+	return info, nil
 }
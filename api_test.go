@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/anaskhan96/soup"
+)
+
+// finite reports whether f is a number other than NaN and the infinities
+func finite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+func TestNormalizeDecimal(t *testing.T) {
+	tests := []struct {
+		num  string
+		want string
+	}{
+		{"123.45", "123.45"},
+		{"123,45", "123.45"},
+		{"1,234", "1234"},
+		{"1,234.56", "1234.56"},
+		{"1.234,56", "1234.56"},
+		{"1.234.567", "1234567"},
+		{"1,234,567", "1234567"},
+		{"0,125", "0.125"},
+		{"0,5", "0.5"},
+		{"1234,567", "1234.567"},
+		{"123.45,", "123.45"},
+		{"123,45.", "123.45"},
+		{"1,234,", "1234"},
+		{",", ""},
+	}
+
+	for _, test := range tests {
+		if got := normalizeDecimal(test.num); got != test.want {
+			t.Errorf("normalizeDecimal(%q) = %q, want %q", test.num, got, test.want)
+		}
+	}
+}
+
+func TestParseRarity(t *testing.T) {
+	tests := []struct {
+		text string
+		want float64
+	}{
+		{"Rarity Score: 123.45", 123.45},
+		{"Rarity Score: 123,45", 123.45},
+		{"Rarity Score: 1.234,56", 1234.56},
+		{"Rarity Score: 1,234.56", 1234.56},
+		{"Rarity Score: 123.45,", 123.45},
+		{"Rarity Score: 0,125", 0.125},
+		{"  Rarity Score: 7 ", 7},
+		{"Rarity Score: ,", -1},
+		{"Score: 12", -1},
+		{"", -1},
+	}
+
+	for _, test := range tests {
+		if got := parseRarity(test.text); got != test.want {
+			t.Errorf("parseRarity(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestParsePercentageDecimals(t *testing.T) {
+	tests := []struct {
+		text string
+		want float64
+	}{
+		{"12.5%", 12.5},
+		{"12,5%", 12.5},
+		{"0,125%", 0.125},
+		{"12.5%,", 12.5},
+	}
+
+	for _, test := range tests {
+		if got := parsePercentage(test.text); got != test.want {
+			t.Errorf("parsePercentage(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
+
+func FuzzParseItem(f *testing.F) {
+	for _, page := range readTestPages(f) {
+		f.Add(page)
+	}
+	f.Add("")
+	f.Add("<h2></h2>")
+	f.Add(`<h2>Test #1</h2><button class="item-rarity-rank"></button><button class="item-trait-data"><b>1</b></button>`)
+	f.Add(`<h2>Test #1</h2><button class="item-rarity-rank">Rank 1 / 1</button><button class="item-trait-data">Rarity Score: 1</button><h3 class="tier-title"></h3><div class="item-rarity-percentage">99999999999999999999 / 0,0</div><div class="item-rarity-tier"></div>`)
+
+	defer func(enabled bool) { lenient = enabled }(lenient)
+
+	f.Fuzz(func(t *testing.T, page string) {
+		for _, lenient = range []bool{false, true} {
+			item, err := ParseItem(page)
+
+			if errors.Is(err, ErrorParsePanic) {
+				t.Fatalf("ParseItem panicked with lenient %v: %v", lenient, err)
+			} else if err != nil {
+				continue
+			}
+
+			if item.Traits == nil {
+				t.Fatal("the traits are nil")
+			}
+			if (item.Rank == -1) != (item.Total == -1) || item.Rank < -1 || item.Total < -1 {
+				t.Fatalf("rank %d of %d", item.Rank, item.Total)
+			}
+			if item.Score != -1 && (item.Score < 0 || !finite(item.Score)) {
+				t.Fatalf("score %v", item.Score)
+			}
+			if item.StatRarity < 0 || !finite(item.StatRarity) || item.TraitNormalizedScore < 0 || !finite(item.TraitNormalizedScore) {
+				t.Fatalf("stat rarity %v, trait normalized score %v", item.StatRarity, item.TraitNormalizedScore)
+			}
+			if item.Supply < 0 || item.RankedTotal < 0 {
+				t.Fatalf("supply %d, ranked total %d", item.Supply, item.RankedTotal)
+			}
+			for key, trait := range item.Traits {
+				if trait.Type != key {
+					t.Fatalf("trait %q is keyed by %q", trait.Type, key)
+				}
+				if trait.Percentage < 0 || !finite(trait.Percentage) {
+					t.Fatalf("trait %q percentage %v", key, trait.Percentage)
+				}
+			}
+			if _, err := json.Marshal(item); err != nil {
+				t.Fatalf("the item doesn't encode: %v", err)
+			}
+		}
+	})
+}
+
+func FuzzParseRank(f *testing.F) {
+	for _, seed := range []string{"Rank 1 / 10", "Rank 1,234 / 9,999", "Rank , / ,", "Rank 99999999999999999999 / 1", "Rank - / -", ""} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, text string) {
+		rank, total := parseRank(text)
+		if (rank == -1) != (total == -1) || rank < -1 || total < -1 {
+			t.Fatalf("parseRank(%q) = %d, %d", text, rank, total)
+		}
+	})
+}
+
+func FuzzParseRarity(f *testing.F) {
+	for _, seed := range []string{"Rarity Score: 123.45", "Rarity Score: 1.234,56", "Rarity Score: ,.,", "Rarity Score: 9" + strings.Repeat("9", 400), ""} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, text string) {
+		if score := parseRarity(text); score != -1 && (score < 0 || !finite(score)) {
+			t.Fatalf("parseRarity(%q) = %v", text, score)
+		}
+	})
+}
+
+func FuzzParseTraitEntry(f *testing.F) {
+	for _, seed := range []string{"Hat: Cap", "Hat: Captain's / Navy", "Hat:Cap", "Hat: ", ": Cap", "Ünïcode: ✓", ""} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, text string) {
+		key, value := parseTraitEntry(text)
+		if key == "" && value != "" {
+			t.Fatalf("parseTraitEntry(%q) = %q, %q without a key", text, key, value)
+		}
+		if key != strings.TrimSpace(key) {
+			t.Fatalf("parseTraitEntry(%q) key %q isn't trimmed", text, key)
+		}
+	})
+}
+
+func FuzzParsePercentage(f *testing.F) {
+	for _, seed := range []string{"12.5%", "12,5%", "12 / 1000", "1 / 0", ", / ,", "NaN%", "Inf", "9" + strings.Repeat("9", 400) + " / 1", ""} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, text string) {
+		if percentage := parsePercentage(text); !finite(percentage) {
+			t.Fatalf("parsePercentage(%q) = %v", text, percentage)
+		}
+	})
+}
+
+func TestParseTraitEntry(t *testing.T) {
+	tests := []struct {
+		text      string
+		wantType  string
+		wantValue string
+	}{
+		{"Hat: Cap", "Hat", "Cap"},
+		{"Hat: Captain's / Navy", "Hat", "Captain's / Navy"},
+		{"Time: 12:30 PM", "Time", "12:30 PM"},
+		{"Background: Rock & Roll", "Background", "Rock & Roll"},
+		{"Level: 42", "Level", "42"},
+		{"Clothes: Café Tee No. 5", "Clothes", "Café Tee No. 5"},
+		{"帽子: 赤い", "帽子", "赤い"},
+		{"  Eyes:   Laser Eyes  ", "Eyes", "Laser Eyes"},
+		{"Eye Color: Blue-Green", "Eye Color", "Blue-Green"},
+		{"Hat:Cap", "", ""},
+		{"Hat", "", ""},
+		{"", "", ""},
+	}
+
+	for _, test := range tests {
+		gotType, gotValue := parseTraitEntry(test.text)
+		if gotType != test.wantType || gotValue != test.wantValue {
+			t.Errorf("parseTraitEntry(%q) = %q, %q, want %q, %q", test.text, gotType, gotValue, test.wantType, test.wantValue)
+		}
+	}
+}
+
+func TestParseRank(t *testing.T) {
+	tests := []struct {
+		text      string
+		wantRank  int
+		wantTotal int
+	}{
+		{"Rank 50 / 1000", 50, 1000},
+		{"Rank 1,234 / 10,000", 1234, 10000},
+		{"Rank 1 / 1,000,000", 1, 1000000},
+		{"  Rank 7 / 7  ", 7, 7},
+		{"Rank , / ,", -1, -1},
+		{"Rank 99999999999999999999 / 1", -1, -1},
+		{"Rank - / -", -1, -1},
+		{"", -1, -1},
+	}
+
+	for _, test := range tests {
+		if rank, total := parseRank(test.text); rank != test.wantRank || total != test.wantTotal {
+			t.Errorf("parseRank(%q) = %d, %d, want %d, %d", test.text, rank, total, test.wantRank, test.wantTotal)
+		}
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	defer func(prefix string, raw bool) { namePrefix, rawNames = prefix, raw }(namePrefix, rawNames)
+	rawNames = false
+
+	tests := []struct {
+		prefix string
+		name   string
+		want   string
+	}{
+		{"", "Cool Cat #1", "Cool Cat #1"},
+		{"", "  Cool Cat #1\n", "Cool Cat #1"},
+		{"", "Cool \t  Cat\n#1", "Cool Cat #1"},
+		{"", "Cool Cat # 1", "Cool Cat #1"},
+		{"", "Cool Cat ## 1", "Cool Cat #1"},
+		{"", "Cool Cat # 1", "Cool Cat #1"},
+		{"", "", ""},
+		{"Cool Cats", "Cool Cats #1", "#1"},
+		{"Cool Cats", "  Cool Cats   # 1 ", "#1"},
+		{"Cool Cats", "Hot Dogs #1", "Hot Dogs #1"},
+	}
+
+	for _, test := range tests {
+		namePrefix = test.prefix
+		if got := normalizeName(test.name); got != test.want {
+			t.Errorf("normalizeName(%q) with prefix %q = %q, want %q", test.name, test.prefix, got, test.want)
+		}
+	}
+
+	rawNames = true
+	if got := normalizeName("  Cool Cat # 1 "); got != "  Cool Cat # 1 " {
+		t.Errorf("normalizeName changed a raw name to %q", got)
+	}
+}
+
+func TestParsePercentage(t *testing.T) {
+	tests := []struct {
+		text string
+		want float64
+	}{
+		{"12.5%", 12.5},
+		{" 12.5 % ", 12.5},
+		{"100%", 100},
+		{"12 / 1000", 1.2},
+		{"12/1000", 1.2},
+		{"1 / 4", 25},
+		{"1,000 / 10,000", 10},
+		{"5 / 0", 0},
+		{", / ,", 0},
+		{"NaN%", 0},
+		{"Inf", 0},
+		{"", 0},
+	}
+
+	for _, test := range tests {
+		if got := parsePercentage(test.text); got != test.want {
+			t.Errorf("parsePercentage(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestParseItemMaxTraits(t *testing.T) {
+	defer func(max int) { maxTraits = max }(maxTraits)
+	maxTraits = 5
+
+	page := &strings.Builder{}
+	page.WriteString(`<html><body><h2>Huge #1</h2><button class="item-rarity-rank">Rank 1 / 10</button><button class="item-trait-data">Rarity Score: 1</button>`)
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(page, `<h3 class="tier-title">Trait %04d: Value</h3><div class="item-rarity-percentage">1%%</div><div class="item-rarity-tier">Rare</div>`, i)
+	}
+	page.WriteString(`</body></html>`)
+
+	item, err := ParseItem(page.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(item.Traits) != maxTraits {
+		t.Fatalf("%d traits were kept, want %d", len(item.Traits), maxTraits)
+	}
+	for i := 0; i < maxTraits; i++ {
+		if _, ok := item.Traits[fmt.Sprintf("Trait %04d", i)]; !ok {
+			t.Errorf("trait %d wasn't kept", i)
+		}
+	}
+
+	want := "traits: only the first 5 of 2000 traits were kept"
+	if len(item.Warnings) != 1 || item.Warnings[0] != want {
+		t.Errorf("warnings %q, want %q", item.Warnings, want)
+	}
+}
+
+func TestRecoverParse(t *testing.T) {
+	before := fetchFailures.snapshot()["parse_panic"]
+
+	parse := func() (err error) {
+		defer recoverParse(&err)
+		soup.Root{}.Children()
+		return nil
+	}
+
+	if err := parse(); !errors.Is(err, ErrorParsePanic) {
+		t.Fatalf("a panicking parse failed with %v, want %v", err, ErrorParsePanic)
+	}
+	if after := fetchFailures.snapshot()["parse_panic"]; after != before+1 {
+		t.Errorf("the parse_panic count went from %d to %d", before, after)
+	}
+}
+
+func TestParseItemBrokenHTML(t *testing.T) {
+	defer func(parser string) { htmlParser = parser }(htmlParser)
+
+	pages := []string{
+		"",
+		"<",
+		"<h2>",
+		"</h2>",
+		"<h2></h2>",
+		"<h2><h2></h2></h2>",
+		"<h2>Broken #1</h2><button class=\"item-rarity-rank\"></button><button class=\"item-trait-data\"></button>",
+		"<h2>Broken #1</h2><button class=\"item-rarity-rank\"><<<",
+		"<h2>Broken #1\x00</h2><h3 class=\"tier-title\"><div class=\"item-rarity-percentage\"><div class=\"item-rarity-tier\">",
+		"<h2>Broken #1</h2><h3 class=\"tier-title\"></h3><div class=\"item-rarity-percentage\"></div><div class=\"item-rarity-tier\"></div>",
+		"<html><body><h2>Broken #1<table><tr><td><h3 class=\"tier-title\">Hat: Cap</td></tr></h2>",
+		"<!DOCTYPE html><!-- <h2>unterminated comment",
+		"<h2><![CDATA[Broken #1]]></h2><script><h2>Hidden</h2></script>",
+	}
+
+	for _, htmlParser = range []string{"soup", "html"} {
+		for _, page := range pages {
+			if _, err := ParseItem(page); errors.Is(err, ErrorParsePanic) {
+				t.Errorf("%s parser: ParseItem(%q) panicked: %v", htmlParser, page, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// This file contains the upstream backoff shared by every request, set from the
+// Retry-After header RarityMon sends when it wants fewer requests
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	backoffMu    sync.Mutex
+	backoffUntil time.Time
+
+	ErrorUpstreamBackoff = errors.New("RarityMon asked for requests to be held off for now")
+)
+
+// noteRetryAfter starts a backoff window from a response's Retry-After header,
+// which is either a number of seconds or an HTTP date
+func noteRetryAfter(resp *http.Response) {
+	val := resp.Header.Get("Retry-After")
+	if val == "" {
+		return
+	}
+
+	until := time.Time{}
+	if seconds, err := strconv.Atoi(val); err == nil {
+		until = time.Now().Add(time.Duration(seconds) * time.Second)
+	} else if date, err := http.ParseTime(val); err == nil {
+		until = date
+	} else {
+		return
+	}
+
+	backoffMu.Lock()
+	if until.After(backoffUntil) {
+		backoffUntil = until
+	}
+	backoffMu.Unlock()
+}
+
+// backoffRemaining returns how long requests to RarityMon should still be held
+// off, 0 once the window has passed
+func backoffRemaining() time.Duration {
+	backoffMu.Lock()
+	defer backoffMu.Unlock()
+
+	if remaining := time.Until(backoffUntil); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
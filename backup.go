@@ -0,0 +1,149 @@
+// This file contains the scheduled gzipped backups of the bolt file
+package main
+
+import (
+	"compress/gzip"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// backupDir is where backups of the bolt file are written every
+	// backupInterval, keeping the newest backupRetention of them, or all of them
+	// when it's 0. An empty directory disables backups.
+	backupDir       = GetenvOrDefault("RARITYMON_BACKUP_DIR", "")
+	backupInterval  = GetenvDurationOrDefault("RARITYMON_BACKUP_INTERVAL", 24*time.Hour)
+	backupRetention = GetenvIntOrDefault("RARITYMON_BACKUP_RETENTION", 7)
+
+	lastBackupMu sync.Mutex
+	lastBackup   *time.Time
+
+	_ = newGaugeFunc("raritymon_last_backup_timestamp_seconds", "Unix time of the last backup of the bolt file, 0 before the first", func() float64 {
+		if at := lastBackupTime(); at != nil {
+			return float64(at.Unix())
+		}
+		return 0
+	})
+)
+
+const (
+	backupPrefix = "raritymon-"
+	backupSuffix = ".db.gz"
+)
+
+func lastBackupTime() *time.Time {
+	lastBackupMu.Lock()
+	defer lastBackupMu.Unlock()
+	return lastBackup
+}
+
+func setLastBackup(at time.Time) {
+	lastBackupMu.Lock()
+	lastBackup = &at
+	lastBackupMu.Unlock()
+}
+
+// listBackups returns the backups in backupDir, oldest first. The timestamps in
+// their names sort in the order they were taken.
+func listBackups() ([]string, error) {
+	files, err := os.ReadDir(backupDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, file := range files {
+		if name := file.Name(); strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			backups = append(backups, filepath.Join(backupDir, name))
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// writeBackup snapshots the bolt file into a new gzipped backup, which only
+// takes its final name once it's complete
+func writeBackup(bc *boltCache, at time.Time) (string, error) {
+	path := filepath.Join(backupDir, backupPrefix+at.UTC().Format("20060102T150405Z")+backupSuffix)
+	tmpPath := path + ".partial"
+
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpPath)
+
+	writer := gzip.NewWriter(file)
+	err = bc.Backup(writer)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return path, os.Rename(tmpPath, path)
+}
+
+// pruneBackups removes all but the newest backupRetention backups
+func pruneBackups() error {
+	backups, err := listBackups()
+	if err != nil || len(backups) <= backupRetention {
+		return err
+	}
+
+	for _, path := range backups[:len(backups)-backupRetention] {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runBackups backs the bolt file up every backupInterval. The last backup time
+// starts out as that of the newest backup already in backupDir.
+func runBackups(cache Cache) {
+	bc, ok := cache.(*boltCache)
+	if !ok || backupDir == "" || backupInterval <= 0 {
+		return
+	}
+
+	if err := os.MkdirAll(backupDir, 0755); err != nil {
+		log.Printf("backup: %v\n", err)
+		return
+	}
+
+	if backups, err := listBackups(); err == nil && len(backups) > 0 {
+		if info, err := os.Stat(backups[len(backups)-1]); err == nil {
+			setLastBackup(info.ModTime().UTC())
+		}
+	}
+
+	for range time.Tick(backupInterval) {
+		now := time.Now().UTC()
+		path, err := writeBackup(bc, now)
+		if err != nil {
+			log.Printf("backup failed: %v\n", err)
+			continue
+		}
+		setLastBackup(now)
+		log.Printf("backed the database up to %s\n", path)
+
+		if backupRetention > 0 {
+			if err := pruneBackups(); err != nil {
+				log.Printf("pruning backups: %v\n", err)
+			}
+		}
+	}
+}
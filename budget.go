@@ -0,0 +1,70 @@
+// This file contains the budget of upstream calls a single item request may make,
+// which retries, double reads and redirects all draw from
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	// requestUpstreamBudget is the most upstream calls, redirects included, an
+	// item request may make, 0 means no limit. Collection wide requests such as
+	// listings are bounded by maxCrawl instead.
+	requestUpstreamBudget = GetenvIntOrDefault("RARITYMON_REQUEST_UPSTREAM_BUDGET", 0)
+
+	ErrorUpstreamBudget = errors.New("the request used up its budget of upstream calls")
+)
+
+// upstreamBudgetKey is the context key of the calls a request has left
+type upstreamBudgetKey struct{}
+
+// withUpstreamBudget gives the request of ctx a fresh budget of upstream calls
+func withUpstreamBudget(ctx context.Context) context.Context {
+	if requestUpstreamBudget <= 0 {
+		return ctx
+	}
+	remaining := int64(requestUpstreamBudget)
+	return context.WithValue(ctx, upstreamBudgetKey{}, &remaining)
+}
+
+// withUpstreamBudgetOf makes the calls made with ctx draw from the budget of the
+// request of from, for work that runs on a context of its own
+func withUpstreamBudgetOf(ctx, from context.Context) context.Context {
+	if remaining, ok := from.Value(upstreamBudgetKey{}).(*int64); ok {
+		return context.WithValue(ctx, upstreamBudgetKey{}, remaining)
+	}
+	return ctx
+}
+
+// spendUpstreamCall takes a call from the budget of the request of ctx. Requests
+// without a budget, such as background jobs, may make as many as they need.
+func spendUpstreamCall(ctx context.Context) error {
+	remaining, ok := ctx.Value(upstreamBudgetKey{}).(*int64)
+	if !ok {
+		return nil
+	}
+	if atomic.AddInt64(remaining, -1) < 0 {
+		return fmt.Errorf("%w of %d", ErrorUpstreamBudget, requestUpstreamBudget)
+	}
+	return nil
+}
+
+// upstreamBudget gives each request of a route its own budget of upstream calls
+func upstreamBudget(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		c.SetRequest(req.WithContext(withUpstreamBudget(req.Context())))
+		return next(c)
+	}
+}
+
+// upstreamBudgetError answers a request that ran out of upstream calls
+func upstreamBudgetError(err error) error {
+	return echo.NewHTTPError(http.StatusServiceUnavailable, errorBody{Message: err.Error(), Code: "upstream_budget"})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestItemUpstreamBudget(t *testing.T) {
+	defer func(transport http.RoundTripper, budget int) {
+		http.DefaultTransport, requestUpstreamBudget = transport, budget
+	}(http.DefaultTransport, requestUpstreamBudget)
+	requestUpstreamBudget = 1
+
+	// every page redirects, so an item takes a second upstream call
+	var calls int64
+	http.DefaultTransport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt64(&calls, 1)
+		header := http.Header{"Location": {req.URL.Path + "?" + req.URL.RawQuery}}
+		return &http.Response{StatusCode: http.StatusFound, Header: header, Body: http.NoBody, Request: req}, nil
+	})
+
+	e := echo.New()
+	e.HTTPErrorHandler = handleError
+	e.GET("/api/:collection/:id", itemHandler(newMemoryCache()), upstreamBudget)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/budget/1", nil))
+
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), ErrorUpstreamBudget.Error()) {
+		t.Errorf("the item request answered %d %s, want %d with %q", rec.Code, rec.Body, http.StatusServiceUnavailable, ErrorUpstreamBudget)
+	}
+	if calls != 1 {
+		t.Errorf("the item request made %d upstream calls on a budget of 1", calls)
+	}
+}
@@ -0,0 +1,602 @@
+// This file contains the cache of scraped items
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	cacheBucket = []byte("RarityCache")
+	pageBucket  = []byte("RawPages")
+
+	// keepPages stores the HTML of every cached item so the cache can be
+	// reparsed after a parser change without going back to RarityMon
+	keepPages = GetenvBoolOrDefault("RARITYMON_KEEP_PAGES", false)
+
+	// readOnly serves purely from a pre-populated database, never scraping or writing
+	readOnly = GetenvBoolOrDefault("RARITYMON_READONLY", false)
+
+	ErrorReadOnly = errors.New("item is not cached and this instance is read-only")
+
+	// retryUnbalanced refetches a page once when its trait nodes are unbalanced,
+	// which usually means it was only partially rendered
+	retryUnbalanced      = GetenvBoolOrDefault("RARITYMON_RETRY_UNBALANCED", false)
+	retryUnbalancedDelay = GetenvDurationOrDefault("RARITYMON_RETRY_UNBALANCED_DELAY", time.Second)
+
+	// maxItemSize is the largest item JSON that gets cached, larger items are still
+	// served but fetched again every time. 0 disables the limit.
+	maxItemSize = GetenvIntOrDefault("RARITYMON_MAX_ITEM_SIZE", 1<<20)
+
+	// parserVersion salts every cache key. Bumping it after changing the
+	// selectors or the parsing invalidates everything parsed the old way without
+	// a flush, leaving a cold cache while items are fetched again. Manual entries
+	// carry over, tombstones and negative cache markers don't.
+	parserVersion = GetenvOrDefault("RARITYMON_PARSER_VERSION", "")
+)
+
+func quickHash(s string) []byte {
+	hash := sha256.New()
+	if parserVersion != "" {
+		hash.Write([]byte(parserVersion + "\x00"))
+	}
+	hash.Write([]byte(s))
+	return hash.Sum(nil)
+}
+
+// collectionNamespace is the prefix every key of a collection starts with
+func collectionNamespace(collection string) []byte {
+	return quickHash(collection)
+}
+
+// cacheKey returns the key an item is stored under, the hash of its collection
+// followed by the hash of its id so a collection's keys can be range scanned
+func cacheKey(collection, id string) []byte {
+	return append(collectionNamespace(collection), quickHash(id)...)
+}
+
+// rekeyedBuckets hold values keyed like the cache entries, which are moved along
+// with them by migrateCacheKeys. Tombstones and negative cache markers expire
+// soon enough that they're left behind.
+var rekeyedBuckets = [][]byte{pageBucket, historyBucket}
+
+// migrateCacheKeys re-keys entries stored under a key scheme other than cacheKey's,
+// along with their pages and history. Entries parsed under another parserVersion
+// are dropped instead, only their pages and history are kept. Entries from
+// before the collection and id were stored alongside the item can't be re-keyed
+// and are left as they are.
+func migrateCacheKeys(cache Cache) error {
+	stale := make(map[string]cacheEntry)
+
+	err := cache.ForEach(cacheBucket, func(k, v []byte) error {
+		entry := decodeEntry(v)
+		if entry.Collection != "" && !bytes.Equal(k, entry.key()) {
+			stale[string(k)] = entry
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	dropped := 0
+	for key, entry := range stale {
+		if entry.ParserVersion != parserVersion && !entry.Manual {
+			dropped++
+		} else if entry, err := resolveEntry(cache, entry); err != nil {
+			return err
+		} else if err := putEntry(cache, entry); err != nil {
+			return err
+		}
+		if err := deleteEntry(cache, []byte(key)); err != nil {
+			return err
+		}
+
+		newKey := entry.key()
+		for _, bucket := range rekeyedBuckets {
+			value, err := cache.Get(bucket, []byte(key))
+			if err != nil {
+				return err
+			} else if value == nil {
+				continue
+			}
+
+			if err := cache.Put(bucket, newKey, value); err != nil {
+				return err
+			}
+			if err := cache.Delete(bucket, []byte(key)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(stale) > 0 {
+		log.Printf("migrated %d cache entries to the current key scheme, dropping %d parsed under another parser version\n", len(stale)-dropped, dropped)
+	}
+	return nil
+}
+
+// cacheEntry is the value stored in the cache bucket. Keeping the collection and
+// id alongside the item makes entries reconstructable despite the hashed keys.
+// Deduplicated entries carry the Hash of their item blob instead of the Item,
+// compressed ones the Gzip of it. Items with a string id carry it as their Token,
+// with an ID of 0.
+type cacheEntry struct {
+	Collection string          `json:"collection"`
+	ID         int             `json:"id"`
+	Token      string          `json:"token,omitempty"`
+	Item       json.RawMessage `json:"item,omitempty"`
+	Hash       string          `json:"hash,omitempty"`
+	Gzip       []byte          `json:"gzip,omitempty"`
+
+	// Manual is set on entries stored through the admin API rather than scraped
+	Manual bool `json:"manual,omitempty"`
+
+	// Pinned entries are never replaced by a refetch
+	Pinned bool `json:"pinned,omitempty"`
+
+	// ParseWarnings are the item's non-fatal parse warnings, see Item.ParseWarnings
+	ParseWarnings []string `json:"parseWarnings,omitempty"`
+
+	// ParserVersion is the parserVersion the entry was stored under
+	ParserVersion string `json:"parserVersion,omitempty"`
+
+	// FetchedAt is when the item was last scraped, or confirmed unchanged
+	FetchedAt *time.Time `json:"fetchedAt,omitempty"`
+
+	// RefreshedAt is when a client last had the item refetched with ?refresh=true
+	RefreshedAt *time.Time `json:"refreshedAt,omitempty"`
+
+	// Partial entries hold an item read from somewhere other than its page, such
+	// as the collection listing, and are always refetched when requested
+	Partial bool `json:"partial,omitempty"`
+
+	// gzipped is the stored compressed item, kept by resolveEntry so it can be
+	// served without recompressing
+	gzipped []byte
+}
+
+// key returns the cache key of the entry, by its Token when it has one
+func (entry cacheEntry) key() []byte {
+	if entry.Token != "" {
+		return cacheKey(entry.Collection, entry.Token)
+	}
+	return cacheKey(entry.Collection, strconv.Itoa(entry.ID))
+}
+
+// name returns the collection and id, or token, of the entry's item for logs
+func (entry cacheEntry) name() string {
+	if entry.Token != "" {
+		return entry.Collection + "/" + entry.Token
+	}
+	return entry.Collection + "/" + strconv.Itoa(entry.ID)
+}
+
+// decodeEntry unwraps a stored value. Values written before entries were wrapped
+// are bare item JSON, those are returned with an empty collection.
+func decodeEntry(value []byte) cacheEntry {
+	entry := cacheEntry{}
+	if err := json.Unmarshal(value, &entry); err != nil || (entry.Item == nil && entry.Hash == "" && entry.Gzip == nil) {
+		return cacheEntry{Item: value}
+	}
+	return entry
+}
+
+// getEntry returns the cache entry of an item with its item loaded
+func getEntry(cache Cache, collection string, id int) (cacheEntry, bool) {
+	return getEntryByKey(cache, cacheKey(collection, strconv.Itoa(id)))
+}
+
+func getEntryByKey(cache Cache, key []byte) (cacheEntry, bool) {
+	value, err := cache.Get(cacheBucket, key)
+	if err != nil || value == nil {
+		return cacheEntry{}, false
+	}
+
+	entry, err := resolveEntry(cache, decodeEntry(value))
+	if err != nil || entry.Item == nil {
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+// updateEntry changes the stored cache entry of an item in place, without
+// loading or rewriting the item itself. Missing and unwrapped entries are left
+// alone.
+func updateEntry(cache Cache, key []byte, update func(entry *cacheEntry)) error {
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	value, err := cache.Get(cacheBucket, key)
+	if err != nil || value == nil {
+		return err
+	}
+
+	entry := decodeEntry(value)
+	if entry.Collection == "" {
+		return nil
+	}
+	update(&entry)
+
+	if value, err = json.Marshal(entry); err != nil {
+		return err
+	}
+	return cache.Put(cacheBucket, key, value)
+}
+
+// markRefreshed records on the cache entry of an item that it was just refreshed
+func markRefreshed(cache Cache, key []byte) error {
+	return updateEntry(cache, key, func(entry *cacheEntry) {
+		now := time.Now().UTC()
+		entry.RefreshedAt = &now
+	})
+}
+
+// markFetched records on the cache entry of an item that a refetch found it unchanged
+func markFetched(cache Cache, key []byte) error {
+	return updateEntry(cache, key, func(entry *cacheEntry) {
+		now := time.Now().UTC()
+		entry.FetchedAt = &now
+	})
+}
+
+// storedEntry returns the cache entry of an item without loading the item itself,
+// for its parse warnings and timestamps
+func storedEntry(cache Cache, collection string, id int) cacheEntry {
+	return storedEntryByKey(cache, cacheKey(collection, strconv.Itoa(id)))
+}
+
+func storedEntryByKey(cache Cache, key []byte) cacheEntry {
+	value, err := cache.Get(cacheBucket, key)
+	if err != nil || value == nil {
+		return cacheEntry{}
+	}
+	return decodeEntry(value)
+}
+
+// getCached returns the cached item JSON, or nil if there is none
+func getCached(cache Cache, collection string, id int) []byte {
+	entry, _ := getEntry(cache, collection, id)
+	return entry.Item
+}
+
+// cachedEntries returns every cache entry of a collection, or of every collection
+// when it's empty, with its item loaded. Entries from before the collection was
+// stored are skipped.
+func cachedEntries(cache Cache, collection string) ([]cacheEntry, error) {
+	entries := []cacheEntry{}
+
+	var prefix []byte
+	if collection != "" {
+		prefix = collectionNamespace(collection)
+	}
+
+	err := cache.ForEachPrefix(cacheBucket, prefix, func(k, v []byte) error {
+		entry := decodeEntry(v)
+		if entry.Collection != "" && (collection == "" || entry.Collection == collection) {
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// blobs can only be loaded once ForEach has released the cache
+	for i := range entries {
+		if entries[i], err = resolveEntry(cache, entries[i]); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// cachedItems returns every cached item of a collection keyed by id, leaving out
+// those cached by a Token as they have no numeric id
+func cachedItems(cache Cache, collection string) (map[int]*Item, error) {
+	items := make(map[int]*Item)
+
+	entries, err := cachedEntries(cache, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.Token != "" {
+			continue
+		}
+
+		item := &Item{}
+		if err := json.Unmarshal(entry.Item, item); err != nil {
+			return nil, err
+		}
+		items[entry.ID] = item
+	}
+
+	return items, nil
+}
+
+// putEntry stores an entry, compressing and deduplicating its item as configured.
+// Entries without an Item are stored as they are.
+func putEntry(cache Cache, entry cacheEntry) error {
+	return writeEntry(cache, entry, true)
+}
+
+// putEntryIfAbsent is putEntry for an item that isn't cached yet, leaving the
+// entry of an item that is as it is
+func putEntryIfAbsent(cache Cache, entry cacheEntry) error {
+	return writeEntry(cache, entry, false)
+}
+
+func writeEntry(cache Cache, entry cacheEntry, overwrite bool) error {
+	entry.ParserVersion = parserVersion
+
+	if entry.Item != nil {
+		value := []byte(entry.Item)
+		entry.Hash, entry.Gzip = "", nil
+
+		if dedupe {
+			identity, shared, err := splitItem(value)
+			if err != nil {
+				return err
+			}
+			if compressCache && len(shared) >= compressMinSize {
+				if shared, err = gzipBytes(shared); err != nil {
+					return err
+				}
+			}
+
+			hash, err := putBlob(cache, shared)
+			if err != nil {
+				return err
+			}
+			entry.Item, entry.Hash = identity, hash
+		} else if compressCache && len(value) >= compressMinSize {
+			gzipped, err := gzipBytes(value)
+			if err != nil {
+				return err
+			}
+			entry.Item, entry.Gzip = nil, gzipped
+		}
+	} else if entry.Hash != "" {
+		// the entry refers to its blob once more, the copy it replaces once less
+		blobMu.Lock()
+		err := changeBlobRefs(cache, entry.Hash, 1)
+		blobMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	value, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	return replaceEntry(cache, entry.key(), value, overwrite)
+}
+
+// deleteEntry deletes the cache entry under key, along with its blob once no
+// other entry refers to it
+func deleteEntry(cache Cache, key []byte) error {
+	return replaceEntry(cache, key, nil, true)
+}
+
+// flushBuckets are cleared of a collection by flushCollection
+var flushBuckets = [][]byte{cacheBucket, pageBucket, historyBucket, tombstoneBucket, negativeBucket}
+
+// flushCollection deletes everything stored about the items of a collection,
+// returning how many cache entries it had
+func flushCollection(cache Cache, collection string) (int, error) {
+	flushed := 0
+
+	for _, bucket := range flushBuckets {
+		keys := [][]byte{}
+		err := cache.ForEachPrefix(bucket, collectionNamespace(collection), func(k, v []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			return nil
+		})
+
+		if err != nil {
+			return flushed, err
+		}
+
+		for _, key := range keys {
+			if bytes.Equal(bucket, cacheBucket) {
+				err = deleteEntry(cache, key)
+			} else {
+				err = cache.Delete(bucket, key)
+			}
+			if err != nil {
+				return flushed, err
+			}
+		}
+
+		if bytes.Equal(bucket, cacheBucket) {
+			flushed = len(keys)
+		}
+	}
+
+	return flushed, nil
+}
+
+func deleteCached(cache Cache, collection string, id int) error {
+	if err := cache.Delete(pageBucket, cacheKey(collection, strconv.Itoa(id))); err != nil {
+		return err
+	}
+	return deleteEntry(cache, cacheKey(collection, strconv.Itoa(id)))
+}
+
+// putCached stores a freshly fetched item, the entry holding its id or token, its
+// JSON and parse warnings, along with the page it was parsed from when keepPages
+// is set, and records it in the item's history. Items over maxItemSize are
+// skipped.
+func putCached(cache Cache, entry cacheEntry, page string) error {
+	if maxItemSize > 0 && len(entry.Item) > maxItemSize {
+		log.Printf("not caching %s, its %d bytes exceed the maximum of %d\n", entry.name(), len(entry.Item), maxItemSize)
+		return nil
+	}
+
+	now := time.Now().UTC()
+	entry.FetchedAt = &now
+	if err := putEntry(cache, entry); err != nil {
+		return err
+	}
+
+	if keepPages && page != "" {
+		if err := cache.Put(pageBucket, entry.key(), []byte(page)); err != nil {
+			return err
+		}
+	}
+
+	if err := recordHistory(cache, entry.key(), entry.Item, false); err != nil {
+		log.Printf("history %s: %v\n", entry.name(), err)
+	}
+	return nil
+}
+
+// fetchTiming records how long the stages of a fetch took
+type fetchTiming struct {
+	Fetch time.Duration
+	Parse time.Duration
+}
+
+// fetchAndParse scrapes an item, refetching once when retryUnbalanced is set and
+// the page came back with unbalanced trait nodes. The page is returned alongside.
+func fetchAndParse(ctx context.Context, collection string, id int, timing *fetchTiming) (*Item, string, error) {
+	item, page, err := fetchAndParseURL(ctx, collection, fmt.Sprintf(RarityMonURL, collection, id), timing)
+	if item != nil {
+		item.TokenID = id
+	}
+	return item, page, err
+}
+
+// fetchEntryItem is fetchAndParse for the item of an entry, by its token when it
+// has one
+func fetchEntryItem(ctx context.Context, entry cacheEntry, timing *fetchTiming) (*Item, string, error) {
+	if entry.Token == "" {
+		return fetchAndParse(ctx, entry.Collection, entry.ID, timing)
+	}
+
+	item, page, err := fetchAndParseURL(ctx, entry.Collection, fmt.Sprintf(RarityMonTokenURL, entry.Collection, url.QueryEscape(entry.Token)), timing)
+	if item != nil {
+		item.Token = entry.Token
+	}
+	return item, page, err
+}
+
+// fetchAndParseURL is fetchAndParse for the item page at url
+func fetchAndParseURL(ctx context.Context, collection, url string, timing *fetchTiming) (*Item, string, error) {
+	for attempt := 0; ; attempt++ {
+		release, err := acquireSlots(ctx, collection)
+		if err != nil {
+			return nil, "", err
+		}
+
+		start := time.Now()
+		page, err := getPage(ctx, url)
+		took := time.Since(start)
+		timing.Fetch += took
+		release()
+
+		if err != nil {
+			return nil, "", err
+		}
+		noteUpstreamLatency(took)
+
+		start = time.Now()
+		item, err := ParseItem(page)
+		timing.Parse += time.Since(start)
+
+		if errors.Is(err, ErrorParsePanic) {
+			log.Printf("parse %s: %v\n", url, err)
+		}
+
+		if attempt > 0 {
+			if err == ErrorNodeLengthMismatch {
+				unbalancedRetries.Inc("failed")
+			} else {
+				unbalancedRetries.Inc("recovered")
+			}
+		}
+
+		if err != ErrorNodeLengthMismatch || !retryUnbalanced || attempt > 0 {
+			return item, page, err
+		}
+
+		select {
+		case <-time.After(retryUnbalancedDelay):
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+	}
+}
+
+// fetchEncoded scrapes an item from RarityMon and encodes it for the cache,
+// returning the page it was parsed from and its parse warnings as well
+func fetchEncoded(ctx context.Context, entry cacheEntry) (encodedJson []byte, page string, warnings []string, timing fetchTiming, err error) {
+	if readOnly {
+		return nil, "", nil, timing, ErrorReadOnly
+	}
+
+	item, page, err := fetchEntryItem(ctx, entry, &timing)
+
+	if err == nil && shouldVerify(ctx, entry.Collection) {
+		item, page, err = verifyItem(ctx, entry, item, &timing)
+	}
+
+	if err != nil {
+		return nil, "", nil, timing, err
+	}
+
+	encodedJson, err = json.MarshalIndent(item, " ", "  ")
+	return encodedJson, page, item.ParseWarnings, timing, err
+}
+
+// fetchAndCache scrapes an item from RarityMon and stores the encoded result in
+// the cache, sharing the fetch with concurrent callers asking for the same item.
+// Pinned items are returned from the cache instead.
+func fetchAndCache(ctx context.Context, cache Cache, collection string, id int) ([]byte, fetchTiming, error) {
+	if entry, ok := getEntry(cache, collection, id); ok && entry.Pinned {
+		return entry.Item, fetchTiming{}, nil
+	}
+
+	if isTombstoned(cache, collection, id) {
+		return nil, fetchTiming{}, ErrorTombstoned
+	}
+
+	if negativeTTL > 0 && hasMarker(cache, negativeBucket, collection, id) {
+		return nil, fetchTiming{}, ErrorNotFound
+	}
+
+	return coalesceFetch(ctx, collection, id, func(ctx context.Context) ([]byte, fetchTiming, error) {
+		encodedJson, page, warnings, timing, err := fetchEncoded(ctx, cacheEntry{Collection: collection, ID: id})
+
+		if err == ErrorItemNotFound && negativeTTL > 0 {
+			if err := putMarker(cache, negativeBucket, collection, id, negativeTTL); err != nil {
+				log.Printf("negative cache %s/%d: %v\n", collection, id, err)
+			}
+		}
+
+		if err != nil {
+			return nil, timing, err
+		}
+
+		if err := putCached(cache, cacheEntry{Collection: collection, ID: id, Item: encodedJson, ParseWarnings: warnings}, page); err != nil {
+			return nil, timing, err
+		}
+
+		return encodedJson, timing, nil
+	})
+}
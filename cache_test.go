@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func encodeTestItem(t *testing.T, item *Item) []byte {
+	t.Helper()
+
+	encodedJson, err := json.MarshalIndent(item, " ", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encodedJson
+}
+
+func TestCacheKeyInjective(t *testing.T) {
+	// the keys used to hash the collection and id joined by a colon, which
+	// couldn't tell these pairs apart
+	if !bytes.Equal(quickHash("a"+":"+"1:1"), quickHash("a:1"+":"+"1")) {
+		t.Fatal("the old keys no longer collide, the test pairs need updating")
+	}
+
+	pairs := [][2]string{
+		{"a", "1:1"},
+		{"a:1", "1"},
+		{"a1", "1"},
+		{"a", "11"},
+		{"", "a1"},
+		{"a1", ""},
+	}
+
+	seen := make(map[string][2]string)
+	for _, pair := range pairs {
+		key := string(cacheKey(pair[0], pair[1]))
+		if other, ok := seen[key]; ok {
+			t.Errorf("collection %q id %q and collection %q id %q share a key", pair[0], pair[1], other[0], other[1])
+		}
+		seen[key] = pair
+
+		if !bytes.HasPrefix([]byte(key), collectionNamespace(pair[0])) {
+			t.Errorf("the key of collection %q id %q isn't in the collection's namespace", pair[0], pair[1])
+		}
+	}
+}
+
+func TestPutCachedMaxItemSize(t *testing.T) {
+	defer func(max, size int) { maxItemSize, historySize = max, size }(maxItemSize, historySize)
+	maxItemSize, historySize = 512, 5
+
+	cache := newMemoryCache()
+
+	traits := TraitMap{}
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("Trait %d", i)
+		traits[name] = Trait{Type: name, Name: "Value", Tier: "Rare", Percentage: 1}
+	}
+	oversized := encodeTestItem(t, &Item{TokenID: 1, Name: "Huge #1", Rank: 1, Total: 10, Score: 1, Traits: traits})
+	small := encodeTestItem(t, &Item{TokenID: 2, Name: "Small #2", Rank: 2, Total: 10, Score: 1, Traits: TraitMap{}})
+
+	if err := putCached(cache, cacheEntry{Collection: "foo", ID: 1, Item: oversized}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := getEntry(cache, "foo", 1); ok {
+		t.Errorf("an item of %d bytes was cached despite the maximum of %d", len(oversized), maxItemSize)
+	}
+	if history, _ := getHistory(cache, cacheKey("foo", "1")); len(history) != 0 {
+		t.Errorf("an item that wasn't cached has %d history snapshots", len(history))
+	}
+
+	if err := putCached(cache, cacheEntry{Collection: "foo", ID: 2, Item: small}, ""); err != nil {
+		t.Fatal(err)
+	}
+	compacted := &bytes.Buffer{}
+	if err := json.Compact(compacted, small); err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := getEntry(cache, "foo", 2); !ok || !bytes.Equal(entry.Item, compacted.Bytes()) {
+		t.Errorf("an item of %d bytes wasn't cached", len(small))
+	}
+	if history, _ := getHistory(cache, cacheKey("foo", "2")); len(history) != 1 {
+		t.Errorf("a cached item has %d history snapshots, want 1", len(history))
+	}
+}
@@ -0,0 +1,82 @@
+// This file contains the coalescing of concurrent fetches of the same item, so a
+// burst of requests for an uncached item only goes upstream once
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	inflightMu sync.Mutex
+	inflight   = make(map[string]*inflightFetch)
+
+	coalescedFetches = newCounter("raritymon_coalesced_fetches_total", "Item fetches that went upstream (leader) or waited for the same fetch already in flight (coalesced)", "collection", "role")
+)
+
+type inflightFetch struct {
+	done        chan struct{}
+	encodedJson []byte
+	timing      fetchTiming
+	err         error
+}
+
+// coalesceFetch runs fetch unless the item is already being fetched, in which case
+// it waits for that fetch and shares its result. Only the leader gets the timing.
+//
+// The fetch doesn't belong to any one caller, so it runs on a context of its own
+// that carries over the leader's deadline, so an ?upstreamTimeout= longer than
+// the server default holds, the leader's budget of upstream calls and whether
+// the item is double read, which is part of what's shared. Each caller, the leader included, stops waiting when its own
+// ctx is done while the fetch carries on for the others and the cache.
+func coalesceFetch(ctx context.Context, collection string, id int, fetch func(context.Context) ([]byte, fetchTiming, error)) ([]byte, fetchTiming, error) {
+	key := string(cacheKey(collection, strconv.Itoa(id)))
+	verify, _ := ctx.Value(verifyKey{}).(bool)
+	if verify {
+		key += "/verify"
+	}
+
+	inflightMu.Lock()
+	f, ok := inflight[key]
+	if ok {
+		inflightMu.Unlock()
+		coalescedFetches.Inc(collection, "coalesced")
+	} else {
+		f = &inflightFetch{done: make(chan struct{})}
+		inflight[key] = f
+		inflightMu.Unlock()
+		coalescedFetches.Inc(collection, "leader")
+
+		go func() {
+			deadline, hasDeadline := ctx.Deadline()
+			if !hasDeadline {
+				deadline = time.Now().Add(upstreamTimeout)
+			}
+			fetchCtx, cancel := context.WithDeadline(context.Background(), deadline)
+			defer cancel()
+			fetchCtx = withUpstreamBudgetOf(fetchCtx, ctx)
+			if verify {
+				fetchCtx = withVerify(fetchCtx)
+			}
+
+			f.encodedJson, f.timing, f.err = fetch(fetchCtx)
+
+			inflightMu.Lock()
+			delete(inflight, key)
+			inflightMu.Unlock()
+			close(f.done)
+		}()
+	}
+
+	select {
+	case <-f.done:
+		if ok {
+			return f.encodedJson, fetchTiming{}, f.err
+		}
+		return f.encodedJson, f.timing, f.err
+	case <-ctx.Done():
+		return nil, fetchTiming{}, ctx.Err()
+	}
+}
@@ -0,0 +1,370 @@
+// This file contains statistics computed over the cached items of a collection
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	collectionMetaBucket = []byte("CollectionMeta")
+
+	thresholdRanks = []int{10, 100, 1000, 10000}
+	thresholdsTTL  = GetenvDurationOrDefault("RARITYMON_THRESHOLDS_TTL", 10*time.Minute)
+
+	thresholdsMu    sync.Mutex
+	thresholdsCache = make(map[string]cachedThresholds)
+
+	// distributionBins is the number of bins a distribution has unless ?bins= is
+	// given, up to maxDistributionBins. At least minDistributionItems scored items
+	// need to be cached for one to be computed.
+	distributionBins     = GetenvIntOrDefault("RARITYMON_DISTRIBUTION_BINS", 10)
+	maxDistributionBins  = GetenvIntOrDefault("RARITYMON_MAX_DISTRIBUTION_BINS", 100)
+	minDistributionItems = GetenvIntOrDefault("RARITYMON_DISTRIBUTION_MIN_ITEMS", 10)
+)
+
+// CollectionMeta is the per collection data kept alongside the cached items
+type CollectionMeta struct {
+	Info      *CollectionInfo `json:"info,omitempty"`
+	LastCrawl *time.Time      `json:"lastCrawl,omitempty"`
+
+	// Total is the item total seen by the last crawl that finished without failures
+	Total int `json:"total,omitempty"`
+}
+
+func getCollectionMeta(cache Cache, collection string) (CollectionMeta, error) {
+	meta := CollectionMeta{}
+	value, err := cache.Get(collectionMetaBucket, []byte(collection))
+
+	if err != nil || value == nil {
+		return meta, err
+	}
+
+	return meta, json.Unmarshal(value, &meta)
+}
+
+func putCollectionMeta(cache Cache, collection string, meta CollectionMeta) error {
+	value, err := json.Marshal(meta)
+
+	if err != nil {
+		return err
+	}
+
+	return cache.Put(collectionMetaBucket, []byte(collection), value)
+}
+
+// getCollectionInfo returns the collection page data, scraping it the first
+// time a collection is enriched
+func getCollectionInfo(cache Cache, collection string) (*CollectionInfo, error) {
+	meta, err := getCollectionMeta(cache, collection)
+
+	if err != nil {
+		return nil, err
+	} else if meta.Info != nil {
+		return meta.Info, nil
+	}
+
+	if readOnly {
+		return nil, ErrorReadOnly
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+
+	meta.Info, err = FetchCollectionInfo(ctx, collection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return meta.Info, putCollectionMeta(cache, collection, meta)
+}
+
+type Thresholds struct {
+	Collection string             `json:"collection"`
+	Total      int                `json:"total"`
+	Cached     int                `json:"cached"`
+	Thresholds map[string]float64 `json:"thresholds"`
+	// Complete is false while a crawl of the collection is still running
+	Complete bool `json:"complete"`
+}
+
+type cachedThresholds struct {
+	thresholds Thresholds
+	expires    time.Time
+}
+
+// computeThresholds finds the score at each of the threshold ranks. Only the cached
+// item holding exactly that rank is trusted, so ranks that aren't cached are omitted.
+func computeThresholds(collection string, items map[int]*Item) Thresholds {
+	thresholds := Thresholds{
+		Collection: collection,
+		Cached:     len(items),
+		Thresholds: make(map[string]float64),
+	}
+
+	scoreAtRank := make(map[int]float64)
+	for _, item := range items {
+		if item.Total > thresholds.Total {
+			thresholds.Total = item.Total
+		}
+		if item.Rank > 0 {
+			scoreAtRank[item.Rank] = item.Score
+		}
+	}
+
+	for _, rank := range thresholdRanks {
+		if score, ok := scoreAtRank[rank]; ok {
+			thresholds.Thresholds[strconv.Itoa(rank)] = score
+		}
+	}
+
+	return thresholds
+}
+
+func thresholdsHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		collection := c.Param("collection")
+
+		thresholdsMu.Lock()
+		cached, ok := thresholdsCache[collection]
+		thresholdsMu.Unlock()
+
+		if ok && time.Now().Before(cached.expires) {
+			thresholds := cached.thresholds
+			thresholds.Complete = crawlComplete(c)
+			return c.JSON(http.StatusOK, thresholds)
+		}
+
+		items, err := cachedItems(cache, collection)
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		thresholds := computeThresholds(collection, items)
+
+		if len(thresholds.Thresholds) == 0 {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "not enough of the collection is cached to compute thresholds")
+		}
+
+		thresholdsMu.Lock()
+		thresholdsCache[collection] = cachedThresholds{thresholds, time.Now().Add(thresholdsTTL)}
+		thresholdsMu.Unlock()
+
+		thresholds.Complete = crawlComplete(c)
+		return c.JSON(http.StatusOK, thresholds)
+	}
+}
+
+// Distribution is a histogram of the scores of a collection's cached items
+type Distribution struct {
+	Collection string            `json:"collection"`
+	Scored     int               `json:"scored"`
+	Min        float64           `json:"min"`
+	Max        float64           `json:"max"`
+	Bins       []DistributionBin `json:"bins"`
+	// Complete is false while a crawl of the collection is still running
+	Complete bool `json:"complete"`
+}
+
+// DistributionBin counts the scores from From up to To, the last bin includes To
+type DistributionBin struct {
+	From  float64 `json:"from"`
+	To    float64 `json:"to"`
+	Count int     `json:"count"`
+}
+
+// computeDistribution splits the range of the scored items into bins of equal
+// width. Items without a score are left out.
+func computeDistribution(collection string, items map[int]*Item, bins int) Distribution {
+	scores := make([]float64, 0, len(items))
+	for _, item := range items {
+		if item.Score >= 0 {
+			scores = append(scores, item.Score)
+		}
+	}
+
+	distribution := Distribution{Collection: collection, Scored: len(scores)}
+	if len(scores) == 0 {
+		return distribution
+	}
+
+	sort.Float64s(scores)
+	distribution.Min, distribution.Max = scores[0], scores[len(scores)-1]
+	width := (distribution.Max - distribution.Min) / float64(bins)
+
+	distribution.Bins = make([]DistributionBin, bins)
+	for i := range distribution.Bins {
+		distribution.Bins[i].From = distribution.Min + float64(i)*width
+		distribution.Bins[i].To = distribution.Min + float64(i+1)*width
+	}
+	distribution.Bins[bins-1].To = distribution.Max
+
+	for _, score := range scores {
+		bin := bins - 1
+		if width > 0 {
+			bin = int((score - distribution.Min) / width)
+		}
+		if bin >= bins {
+			bin = bins - 1
+		}
+		distribution.Bins[bin].Count++
+	}
+
+	return distribution
+}
+
+func distributionHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		collection := c.Param("collection")
+
+		bins := distributionBins
+		if val := c.QueryParam("bins"); val != "" {
+			num, err := strconv.Atoi(val)
+			if err != nil || num < 1 || num > maxDistributionBins {
+				return echo.NewHTTPError(http.StatusBadRequest, "bins must be a number from 1 to "+strconv.Itoa(maxDistributionBins))
+			}
+			bins = num
+		}
+
+		items, err := cachedItems(cache, collection)
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		distribution := computeDistribution(collection, items, bins)
+
+		if distribution.Scored < minDistributionItems {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "not enough of the collection is cached to compute its distribution")
+		}
+
+		distribution.Complete = crawlComplete(c)
+		return c.JSON(http.StatusOK, distribution)
+	}
+}
+
+// computedRank ranks item by how many of the other cached items score higher,
+// returning 0 when no other item of the collection is cached
+func computedRank(item *Item, id int, items map[int]*Item) int {
+	rank, others := 1, 0
+
+	for otherId, other := range items {
+		if otherId == id || other.Score < 0 {
+			continue
+		}
+		others++
+		if other.Score > item.Score {
+			rank++
+		}
+	}
+
+	if others == 0 {
+		return 0
+	}
+	return rank
+}
+
+type SimilarItem struct {
+	ID      int   `json:"id"`
+	Matches int   `json:"matches"`
+	Item    *Item `json:"item"`
+}
+
+// similarItems ranks the other items by how many trait type/value pairs they
+// share with item, breaking ties by rarity score
+func similarItems(item *Item, id int, items map[int]*Item, limit int) []SimilarItem {
+	similar := make([]SimilarItem, 0, len(items))
+
+	for otherId, other := range items {
+		if otherId == id {
+			continue
+		}
+
+		matches := 0
+		for traitType, trait := range item.Traits {
+			if otherTrait, ok := other.Traits[traitType]; ok && otherTrait.Name == trait.Name {
+				matches++
+			}
+		}
+
+		if matches > 0 {
+			similar = append(similar, SimilarItem{otherId, matches, other})
+		}
+	}
+
+	sort.Slice(similar, func(i, j int) bool {
+		if similar[i].Matches != similar[j].Matches {
+			return similar[i].Matches > similar[j].Matches
+		}
+		if similar[i].Item.Score != similar[j].Item.Score {
+			return similar[i].Item.Score > similar[j].Item.Score
+		}
+		return similar[i].ID < similar[j].ID
+	})
+
+	if len(similar) > limit {
+		similar = similar[:limit]
+	}
+	return similar
+}
+
+func similarHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		collection := c.Param("collection")
+		id, err := strconv.Atoi(c.Param("id"))
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		limit := 10
+		if val := c.QueryParam("limit"); val != "" {
+			if limit, err = strconv.Atoi(val); err != nil || limit < 1 {
+				return echo.NewHTTPError(http.StatusBadRequest, "limit must be a positive number")
+			}
+		}
+
+		items, err := cachedItems(cache, collection)
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		item, ok := items[id]
+		if !ok {
+			timeout, err := requestUpstreamTimeout(c)
+
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+
+			ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+			defer cancel()
+
+			encodedJson, _, err := fetchAndCache(ctx, cache, collection, id)
+			if err != nil {
+				return fetchError(c, err, timeout)
+			}
+
+			item = &Item{}
+			if err := json.Unmarshal(encodedJson, item); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+		}
+
+		if len(items) < 2 {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "the collection needs to be crawled before similar items can be found")
+		}
+
+		return c.JSON(http.StatusOK, similarItems(item, id, items, limit))
+	}
+}
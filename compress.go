@@ -0,0 +1,71 @@
+// This file contains the gzip compression of stored items, which are handed to
+// clients accepting gzip without being decompressed
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	// compressCache stores item JSON gzip compressed. Entries written either way
+	// stay readable.
+	compressCache = GetenvBoolOrDefault("RARITYMON_COMPRESS_CACHE", false)
+
+	// compressMinSize is the smallest item JSON that gets compressed, smaller items
+	// barely shrink and are stored as they are
+	compressMinSize = GetenvIntOrDefault("RARITYMON_COMPRESS_MIN_SIZE", 1024)
+)
+
+// gzipMagic starts every gzip stream, item JSON never starts with it
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func isGzipped(value []byte) bool {
+	return bytes.HasPrefix(value, gzipMagic)
+}
+
+func gzipBytes(value []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	writer := gzip.NewWriter(buf)
+
+	if _, err := writer.Write(value); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzipBytes(value []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+// acceptsGzip reports whether the client can take a gzip encoded response
+func acceptsGzip(c echo.Context) bool {
+	for _, encoding := range strings.Split(c.Request().Header.Get(echo.HeaderAcceptEncoding), ",") {
+		encoding, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if strings.TrimSpace(encoding) == "gzip" && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// respondGzipped writes an item stored compressed as is
+func respondGzipped(c echo.Context, gzipped []byte) error {
+	c.Response().Header().Set(echo.HeaderContentEncoding, "gzip")
+	c.Response().Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+	return c.Blob(http.StatusOK, echo.MIMEApplicationJSONCharsetUTF8, gzipped)
+}
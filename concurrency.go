@@ -0,0 +1,177 @@
+// This file contains the limits on concurrent upstream fetches, overall and per
+// collection
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// collectionConcurrency is how many pages of a single collection may be
+	// fetched at once, 0 means no limit. collectionConcurrencyOverrides sets
+	// the limit of individual collections, as "collection=limit,...".
+	collectionConcurrency          = GetenvIntOrDefault("RARITYMON_COLLECTION_CONCURRENCY", 0)
+	collectionConcurrencyOverrides = GetenvIntMap("RARITYMON_COLLECTION_CONCURRENCY_OVERRIDES")
+
+	collectionSlotsMu sync.Mutex
+	collectionSlots   = make(map[string]chan struct{})
+
+	// fetchConcurrency is how many pages may be fetched at once overall, 0
+	// means no limit. Beyond it fetches queue for a slot, at most
+	// fetchQueueDepth of them for up to fetchQueueWait, the rest are turned away
+	// with ErrorFetchQueueFull.
+	fetchConcurrency = GetenvIntOrDefault("RARITYMON_FETCH_CONCURRENCY", 0)
+	fetchQueueDepth  = GetenvIntOrDefault("RARITYMON_FETCH_QUEUE_DEPTH", 100)
+	fetchQueueWait   = GetenvDurationOrDefault("RARITYMON_FETCH_QUEUE_WAIT", 5*time.Second)
+
+	// collectionWeights makes a fetch of the listed collections take that many
+	// of the fetch slots at once, as "collection=weight,...", for collections
+	// whose pages are expensive for RarityMon to serve. Others weigh 1. Weights
+	// only apply while fetchConcurrency limits fetches.
+	collectionWeights = GetenvIntMap("RARITYMON_COLLECTION_WEIGHTS")
+
+	ErrorFetchQueueFull = errors.New("too many items are being fetched from RarityMon, try again shortly")
+
+	fetchSlots  = make(chan struct{}, fetchConcurrency)
+	fetchQueued int64
+
+	// weightedTurn lets one weighted fetch gather its slots at a time, two of
+	// them each holding part of what they need would wait on each other forever
+	weightedTurn = make(chan struct{}, 1)
+
+	_ = newGaugeFunc("raritymon_fetch_queue_depth", "Fetches waiting for a fetch slot", func() float64 {
+		return float64(atomic.LoadInt64(&fetchQueued))
+	})
+	_ = newGaugeFunc("raritymon_fetches_in_flight", "Fetch slots held, weighted fetches holding several, only tracked when the fetch concurrency is limited", func() float64 {
+		return float64(len(fetchSlots))
+	})
+)
+
+// collectionWeight is how many fetch slots a fetch of the collection takes,
+// never more than there are
+func collectionWeight(collection string) int {
+	weight, ok := collectionWeights[collection]
+	if !ok || weight < 1 {
+		return 1
+	} else if weight > fetchConcurrency {
+		return fetchConcurrency
+	}
+	return weight
+}
+
+// acquireFetch waits for the overall fetch slots a fetch of the collection
+// takes, the returned function gives them back. It fails right away when the
+// queue is full and once it waited fetchQueueWait without getting them.
+func acquireFetch(ctx context.Context, collection string) (func(), error) {
+	if fetchConcurrency <= 0 {
+		return func() {}, nil
+	}
+
+	weight := collectionWeight(collection)
+	taken := 0
+	release := func() {
+		for i := 0; i < taken; i++ {
+			<-fetchSlots
+		}
+	}
+
+	if weight == 1 {
+		select {
+		case fetchSlots <- struct{}{}:
+			taken++
+			return release, nil
+		default:
+		}
+	}
+
+	if atomic.AddInt64(&fetchQueued, 1) > int64(fetchQueueDepth) {
+		atomic.AddInt64(&fetchQueued, -1)
+		return nil, ErrorFetchQueueFull
+	}
+	defer atomic.AddInt64(&fetchQueued, -1)
+
+	timer := time.NewTimer(fetchQueueWait)
+	defer timer.Stop()
+
+	if weight > 1 {
+		select {
+		case weightedTurn <- struct{}{}:
+			defer func() { <-weightedTurn }()
+		case <-timer.C:
+			return nil, ErrorFetchQueueFull
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	for taken < weight {
+		select {
+		case fetchSlots <- struct{}{}:
+			taken++
+		case <-timer.C:
+			release()
+			return nil, ErrorFetchQueueFull
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
+
+func collectionLimit(collection string) int {
+	if limit, ok := collectionConcurrencyOverrides[collection]; ok {
+		return limit
+	}
+	return collectionConcurrency
+}
+
+// acquireCollection waits for a fetch slot of the collection, the returned
+// function gives it back
+func acquireCollection(ctx context.Context, collection string) (func(), error) {
+	limit := collectionLimit(collection)
+	if limit <= 0 {
+		return func() {}, nil
+	}
+
+	collectionSlotsMu.Lock()
+	slots, ok := collectionSlots[collection]
+	if !ok {
+		slots = make(chan struct{}, limit)
+		collectionSlots[collection] = slots
+	}
+	collectionSlotsMu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// acquireSlots takes the collection slot and then the overall fetch slots every
+// upstream fetch needs, the returned function gives both back. The collection
+// slot comes first so fetches queued behind a busy collection don't hold fetch
+// slots other collections could use.
+func acquireSlots(ctx context.Context, collection string) (func(), error) {
+	releaseCollection, err := acquireCollection(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	releaseFetch, err := acquireFetch(ctx, collection)
+	if err != nil {
+		releaseCollection()
+		return nil, err
+	}
+
+	return func() {
+		releaseFetch()
+		releaseCollection()
+	}, nil
+}
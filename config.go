@@ -0,0 +1,95 @@
+// This file contains helpers for reading the service configuration from the environment
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func GetenvOrDefault(key, def string) string {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	return val
+}
+
+func GetenvIntOrDefault(key string, def int) int {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+
+	num, err := strconv.Atoi(val)
+	if err != nil {
+		log.Printf("invalid value %q for %s, using default %d\n", val, key, def)
+		return def
+	}
+	return num
+}
+
+func GetenvBoolOrDefault(key string, def bool) bool {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		log.Printf("invalid value %q for %s, using default %t\n", val, key, def)
+		return def
+	}
+	return b
+}
+
+func GetenvDurationOrDefault(key string, def time.Duration) time.Duration {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		log.Printf("invalid value %q for %s, using default %s\n", val, key, def)
+		return def
+	}
+	return d
+}
+
+func GetenvFloatOrDefault(key string, def float64) float64 {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+
+	num, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		log.Printf("invalid value %q for %s, using default %g\n", val, key, def)
+		return def
+	}
+	return num
+}
+
+// GetenvIntMap reads a comma separated list of name=number pairs, such as
+// "a=2,b=8". Invalid pairs are logged and skipped.
+func GetenvIntMap(key string) map[string]int {
+	values := make(map[string]int)
+
+	for _, pair := range strings.Split(os.Getenv(key), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		name, val, _ := strings.Cut(pair, "=")
+		num, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil {
+			log.Printf("invalid pair %q in %s, ignoring it\n", pair, key)
+			continue
+		}
+		values[strings.TrimSpace(name)] = num
+	}
+	return values
+}
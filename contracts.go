@@ -0,0 +1,52 @@
+// This file contains the configured mapping of collections to their on-chain contracts
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+var (
+	// contractsFile is a JSON object mapping collection slugs to a ContractInfo
+	contractsFile = GetenvOrDefault("RARITYMON_CONTRACTS_FILE", "")
+
+	contracts = make(map[string]ContractInfo)
+
+	addressMatcher = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+)
+
+type ContractInfo struct {
+	Address string `json:"address" xml:"address"`
+	Chain   string `json:"chain" xml:"chain"`
+}
+
+// loadContracts reads and validates contractsFile, if one is configured
+func loadContracts() error {
+	if contractsFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(contractsFile)
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[string]ContractInfo)
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("%s: %w", contractsFile, err)
+	}
+
+	for collection, contract := range loaded {
+		if !addressMatcher.MatchString(contract.Address) {
+			return fmt.Errorf("%s: %s has an invalid contract address %q", contractsFile, collection, contract.Address)
+		}
+		if contract.Chain == "" {
+			return fmt.Errorf("%s: %s is missing its chain", contractsFile, collection)
+		}
+	}
+
+	contracts = loaded
+	return nil
+}
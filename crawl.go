@@ -0,0 +1,451 @@
+// This file contains the logic for crawling whole (or partial) collections
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	// maxCrawl is the most items a single collection request is allowed to touch
+	maxCrawl = GetenvIntOrDefault("RARITYMON_MAX_CRAWL", 5000)
+
+	// seedCollections are crawled one after another at startup to warm the cache
+	seedCollections = GetenvOrDefault("RARITYMON_SEED_COLLECTIONS", "")
+
+	// warmOnMiss starts a crawl of a collection that was never crawled the first
+	// time one of its items has to be fetched
+	warmOnMiss = GetenvBoolOrDefault("RARITYMON_WARM_ON_MISS", false)
+
+	ErrorCrawlRunning = errors.New("a crawl is already running for this collection")
+
+	crawlsMu sync.Mutex
+	crawls   = make(map[string]*crawlJob)
+)
+
+type crawlJob struct {
+	Collection string    `json:"collection"`
+	From       int       `json:"from"`
+	To         int       `json:"to"`
+	Cached     int       `json:"cached"`
+	Fetched    int       `json:"fetched"`
+	Failed     int       `json:"failed"`
+	Listed     int       `json:"listed,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+
+	// Skipped is set when the collection total hadn't changed since the last crawl
+	Skipped bool `json:"skipped,omitempty"`
+
+	done chan struct{}
+}
+
+// parseCrawlRange reads the inclusive from/to id range of a collection request,
+// rejecting ranges larger than maxCrawl
+func parseCrawlRange(c echo.Context) (int, int, error) {
+	from := 1
+	if val := c.QueryParam("from"); val != "" {
+		num, err := strconv.Atoi(val)
+		if err != nil {
+			return 0, 0, err
+		}
+		from = num
+	}
+
+	to, err := strconv.Atoi(c.QueryParam("to"))
+	if err != nil {
+		return 0, 0, errors.New("a numeric \"to\" query parameter is required")
+	}
+
+	if to < from {
+		return 0, 0, fmt.Errorf("invalid range %d-%d", from, to)
+	}
+
+	if count := to - from + 1; count > maxCrawl {
+		return 0, 0, fmt.Errorf("range of %d items exceeds the maximum crawl size of %d", count, maxCrawl)
+	}
+
+	return from, to, nil
+}
+
+// startCrawl fetches every uncached id in the range in the background, giving
+// each fetch up to timeout. Only one crawl may run per collection at a time.
+// total is recorded against the collection if the range covers the whole
+// collection, 1 through total, and every fetch succeeds.
+func startCrawl(cache Cache, collection string, from, to int, timeout time.Duration, total int) (crawlJob, error) {
+	crawlsMu.Lock()
+	defer crawlsMu.Unlock()
+
+	if _, running := crawls[collection]; running {
+		return crawlJob{}, ErrorCrawlRunning
+	}
+
+	job := &crawlJob{
+		Collection: collection,
+		From:       from,
+		To:         to,
+		StartedAt:  time.Now(),
+		done:       make(chan struct{}),
+	}
+	crawls[collection] = job
+
+	go func() {
+		defer func() {
+			crawlsMu.Lock()
+			delete(crawls, collection)
+			crawlsMu.Unlock()
+			close(job.done)
+		}()
+
+		var listed map[int]bool
+		if listingCrawl {
+			var err error
+			if listed, err = crawlListing(cache, collection, from, to, timeout); err != nil {
+				log.Printf("crawl %s: listing unavailable, fetching items one by one: %v\n", collection, err)
+			}
+
+			crawlsMu.Lock()
+			job.Listed = len(listed)
+			crawlsMu.Unlock()
+		}
+
+		for id := from; id <= to; id++ {
+			if listed[id] {
+				continue
+			}
+			if getCached(cache, collection, id) != nil {
+				crawlsMu.Lock()
+				job.Cached++
+				crawlsMu.Unlock()
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			_, _, err := fetchAndCache(ctx, cache, collection, id)
+			cancel()
+
+			crawlsMu.Lock()
+			if err != nil {
+				job.Failed++
+			} else {
+				job.Fetched++
+			}
+			crawlsMu.Unlock()
+
+			if err != nil {
+				log.Printf("crawl %s: failed to fetch %d: %v\n", collection, id, err)
+			}
+		}
+
+		log.Printf("crawl %s: finished %d-%d (%d listed, %d fetched, %d failed)\n", collection, from, to, job.Listed, job.Fetched, job.Failed)
+
+		meta, err := getCollectionMeta(cache, collection)
+		if err == nil {
+			now := time.Now().UTC()
+			meta.LastCrawl = &now
+			if job.Failed == 0 && total > 0 && from == 1 && to >= total {
+				meta.Total = total
+			}
+			err = putCollectionMeta(cache, collection, meta)
+		}
+		if err != nil {
+			log.Printf("crawl %s: failed to record the crawl: %v\n", collection, err)
+		}
+	}()
+
+	return *job, nil
+}
+
+func listCollectionHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		collection := c.Param("collection")
+		from, to, err := parseCrawlRange(c)
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		timeout, err := requestUpstreamTimeout(c)
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		items := make(map[int]*Item)
+		for id := from; id <= to; id++ {
+			encodedJson := getCached(cache, collection, id)
+
+			if encodedJson == nil {
+				ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+				encodedJson, _, err = fetchAndCache(ctx, cache, collection, id)
+				cancel()
+				if err != nil {
+					log.Printf("list %s: failed to fetch %d: %v\n", collection, id, err)
+					continue
+				}
+			}
+
+			item := &Item{}
+			if err := json.Unmarshal(encodedJson, item); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+			items[id] = item
+		}
+
+		return c.JSON(http.StatusOK, items)
+	}
+}
+
+// ScanResult is one line of a scan, Status is found, not_found or error
+type ScanResult struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// scanHandler streams which ids of a range resolve to items as newline delimited
+// JSON, fetching the uncached ones like a collection request
+func scanHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		collection := c.Param("collection")
+		from, to, err := parseCrawlRange(c)
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		timeout, err := requestUpstreamTimeout(c)
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+		c.Response().WriteHeader(http.StatusOK)
+
+		encoder := json.NewEncoder(c.Response())
+		for id := from; id <= to; id++ {
+			result := ScanResult{ID: id, Status: "found"}
+
+			if getCached(cache, collection, id) == nil {
+				ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+				_, _, err = fetchAndCache(ctx, cache, collection, id)
+				cancel()
+
+				if err == ErrorItemNotFound || err == ErrorNotFound || err == ErrorTombstoned || errors.Is(err, ErrorNodeNotFound) {
+					result.Status = "not_found"
+				} else if err != nil {
+					result.Status, result.Error = "error", err.Error()
+				}
+			}
+
+			if err := encoder.Encode(result); err != nil {
+				return err
+			}
+			c.Response().Flush()
+
+			if c.Request().Context().Err() != nil {
+				return nil
+			}
+		}
+		return nil
+	}
+}
+
+// probeTotal fetches the first item of a crawl to read the collection's current
+// total, returning 0 when it can't be read
+func probeTotal(cache Cache, collection string, id int, timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	encodedJson, _, err := fetchAndCache(ctx, cache, collection, id)
+
+	item := &Item{}
+	if err == nil {
+		err = json.Unmarshal(encodedJson, item)
+	}
+
+	if err != nil {
+		log.Printf("crawl %s: couldn't read the collection total: %v\n", collection, err)
+		return 0
+	}
+	return item.Total
+}
+
+// startCrawlHandler starts a crawl unless the collection total is the same as
+// when it was last crawled completely, ?force=true crawls regardless
+func startCrawlHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if readOnly {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "crawling is disabled on a read-only instance")
+		}
+
+		from, to, err := parseCrawlRange(c)
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		timeout, err := requestUpstreamTimeout(c)
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		collection := c.Param("collection")
+		total := probeTotal(cache, collection, from, timeout)
+
+		if force, _ := strconv.ParseBool(c.QueryParam("force")); !force && total > 0 {
+			meta, err := getCollectionMeta(cache, collection)
+
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+
+			if meta.Total == total {
+				log.Printf("crawl %s: total unchanged at %d, skipping\n", collection, total)
+				return c.JSON(http.StatusOK, crawlJob{Collection: collection, From: from, To: to, Skipped: true})
+			}
+
+			log.Printf("crawl %s: total changed from %d to %d, crawling\n", collection, meta.Total, total)
+		}
+
+		job, err := startCrawl(cache, collection, from, to, timeout, total)
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusConflict, err.Error())
+		}
+
+		return c.JSON(http.StatusAccepted, job)
+	}
+}
+
+// crawlCompleteKey is the context key crawlCompleteness passes whether the
+// collection's data is complete under, see crawlComplete
+const crawlCompleteKey = "crawlComplete"
+
+// crawlCompleteness marks collection responses with whether a crawl of the
+// collection is still running in the X-Crawl-Complete header, and in their
+// complete field or that of the envelope through crawlComplete. With
+// ?waitForComplete=true the request is refused with a 425 instead, and a
+// Retry-After estimated from the crawl's progress so far.
+func crawlCompleteness(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		crawlsMu.Lock()
+		job, running := crawls[c.Param("collection")]
+		var retryAfter time.Duration
+		if running {
+			retryAfter = job.remaining()
+		}
+		crawlsMu.Unlock()
+
+		c.Response().Header().Set("X-Crawl-Complete", strconv.FormatBool(!running))
+		c.Set(crawlCompleteKey, !running)
+
+		if wait, _ := strconv.ParseBool(c.QueryParam("waitForComplete")); wait && running {
+			c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(retryAfter.Seconds())+1))
+			return echo.NewHTTPError(http.StatusTooEarly, "a crawl of this collection is still running")
+		}
+
+		return next(c)
+	}
+}
+
+// crawlComplete reports whether crawlCompleteness found no crawl of the collection
+// running, which routes without it are taken to be
+func crawlComplete(c echo.Context) bool {
+	complete, ok := c.Get(crawlCompleteKey).(bool)
+	return complete || !ok
+}
+
+// remaining estimates how long the crawl will take to finish from how long the
+// items so far took. crawlsMu must be held.
+func (job *crawlJob) remaining() time.Duration {
+	done := job.Cached + job.Fetched + job.Failed
+	if done == 0 {
+		return 30 * time.Second
+	}
+
+	left := job.To - job.From + 1 - done
+	return time.Since(job.StartedAt) / time.Duration(done) * time.Duration(left)
+}
+
+func crawlStatusHandler(c echo.Context) error {
+	crawlsMu.Lock()
+	defer crawlsMu.Unlock()
+
+	job, ok := crawls[c.Param("collection")]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "no crawl is running for this collection")
+	}
+
+	return c.JSON(http.StatusOK, job)
+}
+
+// warmCollection starts a crawl of a collection up to the total of a freshly
+// fetched item of it, unless the collection was crawled before or is being crawled
+func warmCollection(cache Cache, collection string, encodedJson []byte) {
+	meta, err := getCollectionMeta(cache, collection)
+	if err != nil || meta.LastCrawl != nil {
+		return
+	}
+
+	item := &Item{}
+	if err := json.Unmarshal(encodedJson, item); err != nil || item.Total <= 0 {
+		return
+	}
+
+	to := item.Total
+	if to > maxCrawl {
+		to = maxCrawl
+	}
+
+	if _, err := startCrawl(cache, collection, 1, to, upstreamTimeout, item.Total); err == nil {
+		log.Printf("warm %s: crawling 1-%d after a cold miss\n", collection, to)
+	}
+}
+
+// runSeedCrawls crawls each of seedCollections up to its total, capped at maxCrawl
+func runSeedCrawls(cache Cache) {
+	if seedCollections == "" || readOnly {
+		return
+	}
+
+	for _, collection := range strings.Split(seedCollections, ",") {
+		collection = strings.TrimSpace(collection)
+		if collection == "" {
+			continue
+		}
+
+		total := probeTotal(cache, collection, 1, upstreamTimeout)
+		if total <= 0 {
+			log.Printf("seed %s: skipping, the collection total is unknown\n", collection)
+			continue
+		}
+
+		to := total
+		if to > maxCrawl {
+			to = maxCrawl
+		}
+
+		job, err := startCrawl(cache, collection, 1, to, upstreamTimeout, total)
+		if err != nil {
+			log.Printf("seed %s: %v\n", collection, err)
+			continue
+		}
+
+		log.Printf("seed %s: crawling 1-%d\n", collection, to)
+		<-job.done
+	}
+
+	log.Println("seed: all collections crawled")
+}
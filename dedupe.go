@@ -0,0 +1,242 @@
+// This file contains the content addressed storage letting identical items share one value
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+)
+
+var (
+	blobBucket     = []byte("ItemBlobs")
+	blobRefsBucket = []byte("ItemBlobRefs")
+
+	// dedupe stores the part of an item's JSON identical items have in common
+	// once per distinct content, with the cache entries referring to it by hash
+	// and keeping the rest themselves. Entries written either way stay readable.
+	dedupe = GetenvBoolOrDefault("RARITYMON_DEDUPE", false)
+
+	// sharedItemFields are the fields of an item's JSON kept in its blob, its
+	// traits and the rarity derived from them. Its id, name and rank stay with
+	// its cache entry, otherwise no two items would ever share a blob.
+	sharedItemFields = []string{"traits", "score", "statRarity", "traitNormalizedScore", "itemTier", "total", "rankedTotal", "supply"}
+
+	// blobMu keeps the blob reference counts in step with the entries referring
+	// to them, the count of a blob being read and written around each write
+	blobMu sync.Mutex
+)
+
+// splitItem separates the shared fields of an item's JSON from the rest
+func splitItem(itemJson []byte) (identity, shared []byte, err error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(itemJson, &fields); err != nil {
+		return nil, nil, err
+	}
+
+	sharedFields := make(map[string]json.RawMessage, len(sharedItemFields))
+	for _, name := range sharedItemFields {
+		if value, ok := fields[name]; ok {
+			sharedFields[name] = value
+			delete(fields, name)
+		}
+	}
+
+	if identity, err = json.Marshal(fields); err != nil {
+		return nil, nil, err
+	}
+	shared, err = json.Marshal(sharedFields)
+	return identity, shared, err
+}
+
+// joinItem puts an item split by splitItem back together, encoded the way
+// scraped items are
+func joinItem(identity, shared []byte) ([]byte, error) {
+	item := &Item{}
+	if err := json.Unmarshal(shared, item); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(identity, item); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(item, " ", "  ")
+}
+
+// changeBlobRefs adds delta to the references to a blob, deleting the blob once
+// nothing refers to it. blobMu must be held.
+func changeBlobRefs(cache Cache, hash string, delta int) error {
+	value, err := cache.Get(blobRefsBucket, []byte(hash))
+	if err != nil {
+		return err
+	}
+
+	refs, _ := strconv.Atoi(string(value))
+	if refs += delta; refs > 0 {
+		return cache.Put(blobRefsBucket, []byte(hash), []byte(strconv.Itoa(refs)))
+	}
+
+	if err := cache.Delete(blobRefsBucket, []byte(hash)); err != nil {
+		return err
+	}
+	return cache.Delete(blobBucket, []byte(hash))
+}
+
+// putBlob stores value under the hash of its content and returns the hash,
+// counting the entry about to refer to it
+func putBlob(cache Cache, value []byte) (string, error) {
+	sum := sha256.Sum256(value)
+	hash := hex.EncodeToString(sum[:])
+
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	if err := cache.Put(blobBucket, []byte(hash), value); err != nil {
+		return "", err
+	}
+	return hash, changeBlobRefs(cache, hash, 1)
+}
+
+// replaceEntry stores value as the cache entry under key, or deletes the entry
+// when value is nil, dropping the reference of the entry it replaces to its
+// blob. The reference of the new entry was counted by putBlob. Without
+// overwrite an entry already under key is kept, and value dropped instead.
+func replaceEntry(cache Cache, key, value []byte, overwrite bool) error {
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	previous, err := cache.Get(cacheBucket, key)
+	if err != nil {
+		return err
+	}
+
+	if previous != nil && !overwrite {
+		if hash := decodeEntry(value).Hash; hash != "" {
+			return changeBlobRefs(cache, hash, -1)
+		}
+		return nil
+	}
+
+	if value == nil {
+		err = cache.Delete(cacheBucket, key)
+	} else {
+		err = cache.Put(cacheBucket, key, value)
+	}
+	if err != nil || previous == nil {
+		return err
+	}
+
+	if hash := decodeEntry(previous).Hash; hash != "" {
+		return changeBlobRefs(cache, hash, -1)
+	}
+	return nil
+}
+
+// resolveEntry loads the item of an entry that refers to a blob or was stored
+// compressed. Blobs are compressed when they start with the gzip magic. Entries
+// with an Item as well as a Hash hold the part of the item not in the blob,
+// those without an Item were stored before items were split and the blob holds
+// all of it.
+func resolveEntry(cache Cache, entry cacheEntry) (cacheEntry, error) {
+	if entry.Hash != "" {
+		value, err := cache.Get(blobBucket, []byte(entry.Hash))
+		if err != nil {
+			return entry, err
+		}
+
+		if isGzipped(value) {
+			if entry.Item == nil {
+				entry.Hash, entry.Gzip = "", value
+				return resolveEntry(cache, entry)
+			}
+			if value, err = gunzipBytes(value); err != nil {
+				return entry, err
+			}
+		}
+
+		if entry.Item == nil {
+			entry.Item = value
+		} else if entry.Item, err = joinItem(entry.Item, value); err != nil {
+			return entry, err
+		}
+		entry.Hash = ""
+	}
+
+	if entry.Item == nil && entry.Gzip != nil {
+		item, err := gunzipBytes(entry.Gzip)
+		if err != nil {
+			return entry, err
+		}
+		entry.Item, entry.gzipped, entry.Gzip = item, entry.Gzip, nil
+	}
+
+	return entry, nil
+}
+
+// pruneBlobs recounts the references to every blob from the cache entries and
+// deletes the blobs nothing refers to anymore. Entries keep the counts up to date
+// as they're replaced and deleted, this catches up with anything written before
+// they were counted.
+func pruneBlobs(cache Cache) error {
+	referenced := make(map[string]int)
+
+	err := cache.ForEach(cacheBucket, func(k, v []byte) error {
+		if entry := decodeEntry(v); entry.Hash != "" {
+			referenced[entry.Hash]++
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	unreferenced := [][]byte{}
+	err = cache.ForEach(blobBucket, func(k, v []byte) error {
+		if referenced[string(k)] == 0 {
+			unreferenced = append(unreferenced, append([]byte{}, k...))
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	stale := [][]byte{}
+	err = cache.ForEach(blobRefsBucket, func(k, v []byte) error {
+		if referenced[string(k)] == 0 {
+			stale = append(stale, append([]byte{}, k...))
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	for _, key := range unreferenced {
+		if err := cache.Delete(blobBucket, key); err != nil {
+			return err
+		}
+	}
+	for _, key := range stale {
+		if err := cache.Delete(blobRefsBucket, key); err != nil {
+			return err
+		}
+	}
+	for hash, refs := range referenced {
+		if err := cache.Put(blobRefsBucket, []byte(hash), []byte(strconv.Itoa(refs))); err != nil {
+			return err
+		}
+	}
+
+	if len(unreferenced) > 0 {
+		log.Printf("pruned %d unreferenced item blobs\n", len(unreferenced))
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func countBlobs(t *testing.T, cache Cache) int {
+	t.Helper()
+
+	blobs := 0
+	if err := cache.ForEach(blobBucket, func(k, v []byte) error {
+		blobs++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return blobs
+}
+
+func TestDedupeSharesBlobs(t *testing.T) {
+	defer func(enabled bool) { dedupe = enabled }(dedupe)
+	dedupe = true
+
+	cache := newMemoryCache()
+	traits := TraitMap{"Hat": {Type: "Hat", Name: "Cap", Tier: "Rare", Percentage: 1.5}}
+
+	first := encodeTestItem(t, &Item{TokenID: 1, Name: "Test #1", Rank: 3, Total: 10, Score: 12.5, Traits: traits})
+	second := encodeTestItem(t, &Item{TokenID: 2, Name: "Test #2", Rank: 4, Total: 10, Score: 12.5, Traits: traits})
+
+	for id, encodedJson := range map[int][]byte{1: first, 2: second} {
+		if err := putEntry(cache, cacheEntry{Collection: "foo", ID: id, Item: encodedJson}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if blobs := countBlobs(t, cache); blobs != 1 {
+		t.Fatalf("items with the same traits are stored in %d blobs, want 1", blobs)
+	}
+
+	for id, want := range map[int][]byte{1: first, 2: second} {
+		entry, ok := getEntry(cache, "foo", id)
+		if !ok {
+			t.Fatalf("item %d isn't cached", id)
+		}
+		if !bytes.Equal(entry.Item, want) {
+			t.Errorf("item %d resolved to\n%s\nwant\n%s", id, entry.Item, want)
+		}
+	}
+
+	// replacing one item leaves the blob to the other
+	changed := encodeTestItem(t, &Item{TokenID: 1, Name: "Test #1", Rank: 3, Total: 10, Score: 2, Traits: TraitMap{}})
+	if err := putEntry(cache, cacheEntry{Collection: "foo", ID: 1, Item: changed}); err != nil {
+		t.Fatal(err)
+	}
+	if blobs := countBlobs(t, cache); blobs != 2 {
+		t.Fatalf("%d blobs after replacing an item, want 2", blobs)
+	}
+
+	if err := deleteCached(cache, "foo", 2); err != nil {
+		t.Fatal(err)
+	}
+	if blobs := countBlobs(t, cache); blobs != 1 {
+		t.Fatalf("%d blobs after deleting the last item referring to one, want 1", blobs)
+	}
+
+	if err := deleteCached(cache, "foo", 1); err != nil {
+		t.Fatal(err)
+	}
+	if blobs := countBlobs(t, cache); blobs != 0 {
+		t.Fatalf("%d blobs after deleting every item, want 0", blobs)
+	}
+}
+
+func TestDedupeRewriteKeepsBlob(t *testing.T) {
+	defer func(enabled bool) { dedupe = enabled }(dedupe)
+	dedupe = true
+
+	cache := newMemoryCache()
+	encodedJson := encodeTestItem(t, &Item{TokenID: 1, Name: "Test #1", Rank: 1, Total: 10, Score: 1, Traits: TraitMap{}})
+
+	for i := 0; i < 3; i++ {
+		if err := putEntry(cache, cacheEntry{Collection: "foo", ID: 1, Item: encodedJson}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entry, ok := getEntry(cache, "foo", 1)
+	if !ok || !bytes.Equal(entry.Item, encodedJson) {
+		t.Fatalf("rewritten item resolved to %s, want %s", entry.Item, encodedJson)
+	}
+
+	if err := deleteCached(cache, "foo", 1); err != nil {
+		t.Fatal(err)
+	}
+	if blobs := countBlobs(t, cache); blobs != 0 {
+		t.Fatalf("%d blobs left after deleting a rewritten item, want 0", blobs)
+	}
+}
+
+func TestDedupeCompressedBlobs(t *testing.T) {
+	defer func(enabled, compress bool, size int) {
+		dedupe, compressCache, compressMinSize = enabled, compress, size
+	}(dedupe, compressCache, compressMinSize)
+	dedupe, compressCache, compressMinSize = true, true, 1
+
+	cache := newMemoryCache()
+	encodedJson := encodeTestItem(t, &Item{TokenID: 5, Name: "Test #5", Rank: 5, Total: 10, Score: 3, Traits: TraitMap{"Eyes": {Type: "Eyes", Name: "Blue"}}})
+
+	if err := putEntry(cache, cacheEntry{Collection: "foo", ID: 5, Item: encodedJson}); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, ok := getEntry(cache, "foo", 5)
+	if !ok || !bytes.Equal(entry.Item, encodedJson) {
+		t.Fatalf("compressed item resolved to %s, want %s", entry.Item, encodedJson)
+	}
+}
+
+func TestPruneBlobsRecountsReferences(t *testing.T) {
+	defer func(enabled bool) { dedupe = enabled }(dedupe)
+	dedupe = true
+
+	cache := newMemoryCache()
+	encodedJson := encodeTestItem(t, &Item{TokenID: 1, Name: "Test #1", Traits: TraitMap{}})
+
+	if err := putEntry(cache, cacheEntry{Collection: "foo", ID: 1, Item: encodedJson}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Put(blobBucket, []byte("orphan"), []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Delete(blobRefsBucket, []byte(storedEntry(cache, "foo", 1).Hash)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pruneBlobs(cache); err != nil {
+		t.Fatal(err)
+	}
+	if blobs := countBlobs(t, cache); blobs != 1 {
+		t.Fatalf("%d blobs after pruning, want 1", blobs)
+	}
+
+	if err := deleteCached(cache, "foo", 1); err != nil {
+		t.Fatal(err)
+	}
+	if blobs := countBlobs(t, cache); blobs != 0 {
+		t.Fatalf("%d blobs after deleting the item, want 0", blobs)
+	}
+}
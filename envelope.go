@@ -0,0 +1,31 @@
+// This file contains the optional envelope wrapped around every JSON response
+package main
+
+// responseEnvelope wraps JSON responses as {"data": ..., "error": ..., "meta": ...}
+// instead of returning the bare value, with "complete" added on collection routes.
+// XML responses are never wrapped.
+var responseEnvelope = GetenvBoolOrDefault("RARITYMON_RESPONSE_ENVELOPE", false)
+
+type envelope struct {
+	Data  interface{}   `json:"data"`
+	Error interface{}   `json:"error"`
+	Meta  *responseMeta `json:"meta"`
+	// Complete is whether the collection's data is complete, see crawlCompleteness
+	Complete *bool `json:"complete,omitempty"`
+}
+
+// envelop wraps a response value, error responses carry the value as the error
+func envelop(status int, i interface{}) envelope {
+	if status >= 400 {
+		return envelope{Error: i}
+	}
+
+	if response, ok := i.(itemResponse); ok && response.Meta != nil {
+		// the envelope has a place of its own for the item's _meta
+		meta := response.Meta
+		response.Meta = nil
+		return envelope{Data: response, Meta: meta}
+	}
+
+	return envelope{Data: i}
+}
@@ -3,17 +3,20 @@ module github.com/ninjaswtf/raritymon-api
 go 1.19
 
 require (
-	github.com/anaskhan96/soup v1.2.5 // indirect
+	github.com/anaskhan96/soup v1.2.5
+	github.com/labstack/echo/v4 v4.9.1
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/net v0.0.0-20211015210444-4f30a5c0130f
+)
+
+require (
 	github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
-	github.com/labstack/echo/v4 v4.9.1 // indirect
 	github.com/labstack/gommon v0.4.0 // indirect
 	github.com/mattn/go-colorable v0.1.11 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v1.2.1 // indirect
-	go.etcd.io/bbolt v1.3.6 // indirect
 	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5 // indirect
-	golang.org/x/net v0.0.0-20211015210444-4f30a5c0130f // indirect
 	golang.org/x/sys v0.0.0-20211103235746-7861aae1554b // indirect
 	golang.org/x/text v0.3.7 // indirect
 	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324 // indirect
@@ -0,0 +1,94 @@
+// This file contains the HEAD item routes, which answer from the cache alone for
+// monitoring and cache validation
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// headMissStatus answers HEAD requests for uncached items, which are never
+// fetched, such as 404 or 204
+var headMissStatus = GetenvIntOrDefault("RARITYMON_HEAD_MISS_STATUS", http.StatusNotFound)
+
+// headWriter takes the place of the response writer while a HEAD response is
+// rendered, measuring and hashing the body instead of sending it so the headers
+// can describe it
+type headWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+	hash   hash.Hash
+}
+
+func (w *headWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *headWriter) Write(b []byte) (int, error) {
+	w.size += len(b)
+	return w.hash.Write(b)
+}
+
+// headCacheControl tells clients how long the cached copy of an item stays fresh,
+// until its TTL runs out, or to revalidate it when it doesn't expire
+func headCacheControl(collection string, entry cacheEntry) string {
+	ttl := collectionTTL(collection)
+	if ttl <= 0 || entry.Manual || entry.Pinned || entryExpired(collection, entry) {
+		return "no-cache"
+	}
+	return fmt.Sprintf("max-age=%d", int((ttl - time.Since(*entry.FetchedAt)).Seconds()))
+}
+
+// headItemHandler answers HEAD requests for an item with the headers the GET
+// would have, Content-Length, ETag and Cache-Control included, along with 304
+// when If-None-Match holds the ETag
+func headItemHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		requested, err := requestedEntry(c)
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		entry, ok := getEntryByKey(cache, requested.key())
+		if !ok {
+			return c.NoContent(headMissStatus)
+		}
+
+		res := c.Response()
+		writer := &headWriter{ResponseWriter: res.Writer, status: http.StatusOK, hash: sha256.New()}
+		res.Writer = writer
+
+		describeEntry(c, entry)
+		if entry.gzipped != nil && acceptsGzip(c) && plainItemRequest(c) {
+			err = respondGzipped(c, entry.gzipped)
+		} else {
+			err = respondItem(c, cache, entry.Item, responseMeta{CacheHit: true})
+		}
+
+		res.Writer = writer.ResponseWriter
+		if err != nil {
+			return err
+		}
+
+		etag := fmt.Sprintf(`"%x"`, writer.hash.Sum(nil)[:16])
+		res.Header().Set("ETag", etag)
+		res.Header().Set("Cache-Control", headCacheControl(requested.Collection, entry))
+
+		if c.Request().Header.Get("If-None-Match") == etag {
+			res.Status = http.StatusNotModified
+		} else {
+			res.Status = writer.status
+			res.Header().Set(echo.HeaderContentLength, strconv.Itoa(writer.size))
+		}
+		res.Writer.WriteHeader(res.Status)
+		return nil
+	}
+}
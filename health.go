@@ -0,0 +1,81 @@
+// This file contains the health reporting and housekeeping of the storage
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	// compactInterval is how often the bolt file is checked for compaction, 0 disables it
+	compactInterval  = GetenvDurationOrDefault("RARITYMON_COMPACT_INTERVAL", 0)
+	compactFreeRatio = GetenvFloatOrDefault("RARITYMON_COMPACT_FREE_RATIO", 0.5)
+)
+
+type Health struct {
+	Status      string `json:"status"`
+	Backend     string `json:"backend"`
+	DBSizeBytes int64  `json:"dbSizeBytes,omitempty"`
+
+	// LastBackup is when the last backup of the bolt file was written
+	LastBackup *time.Time `json:"lastBackup,omitempty"`
+
+	// Degraded explains why the status is degraded
+	Degraded string `json:"degraded,omitempty"`
+}
+
+func registerStorageMetrics(cache Cache) {
+	if bc, ok := cache.(*boltCache); ok {
+		newGaugeFunc("raritymon_db_size_bytes", "Size of the bolt database file", func() float64 {
+			return float64(bc.Size())
+		})
+		newGaugeFunc("raritymon_db_free_ratio", "Share of the bolt database file taken up by free pages", bc.FreeRatio)
+	}
+}
+
+// runCompactor periodically compacts the bolt file once enough of it is free pages
+func runCompactor(cache Cache) {
+	bc, ok := cache.(*boltCache)
+	if !ok || readOnly || compactInterval <= 0 {
+		return
+	}
+
+	for range time.Tick(compactInterval) {
+		ratio := bc.FreeRatio()
+		if ratio < compactFreeRatio {
+			continue
+		}
+
+		before := bc.Size()
+		if err := bc.Compact(); err != nil {
+			log.Printf("compaction failed: %v\n", err)
+			continue
+		}
+		log.Printf("compacted database from %d to %d bytes (%.0f%% free)\n", before, bc.Size(), ratio*100)
+	}
+}
+
+func healthHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		health := Health{Status: "ok", LastBackup: lastBackupTime()}
+
+		switch cache := cache.(type) {
+		case *boltCache:
+			health.Backend = "bolt"
+			health.DBSizeBytes = cache.Size()
+		case *memoryCache:
+			health.Backend = "memory"
+		case noCache:
+			health.Backend = "none"
+		}
+
+		if degraded != "" {
+			health.Status, health.Degraded = "degraded", degraded
+		}
+
+		return c.JSON(http.StatusOK, health)
+	}
+}
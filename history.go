@@ -0,0 +1,111 @@
+// This file contains the bounded rank and score history kept for every item
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	historyBucket = []byte("ItemHistory")
+
+	// historySize is how many snapshots are kept per item, 0 disables the history
+	historySize = GetenvIntOrDefault("RARITYMON_HISTORY_SIZE", 30)
+)
+
+// ItemSnapshot is an item's ranking as of a fetch
+type ItemSnapshot struct {
+	Rank  int       `json:"rank"`
+	Total int       `json:"total"`
+	Score float64   `json:"score"`
+	Time  time.Time `json:"time"`
+
+	// Manual is set on snapshots of values stored through the admin API
+	Manual bool `json:"manual,omitempty"`
+}
+
+// getHistory returns the snapshots of the item stored under the cache key
+func getHistory(cache Cache, key []byte) ([]ItemSnapshot, error) {
+	history := []ItemSnapshot{}
+	value, err := cache.Get(historyBucket, key)
+
+	if err != nil || value == nil {
+		return history, err
+	}
+
+	err = json.Unmarshal(value, &history)
+	return history, err
+}
+
+// recordHistory appends a snapshot of the item when its ranking differs from the
+// last one recorded, dropping the oldest snapshots beyond historySize
+func recordHistory(cache Cache, key []byte, itemJson []byte, manual bool) error {
+	if historySize <= 0 {
+		return nil
+	}
+
+	item := Item{}
+	if err := json.Unmarshal(itemJson, &item); err != nil {
+		return err
+	}
+
+	history, err := getHistory(cache, key)
+	if err != nil {
+		return err
+	}
+
+	if n := len(history); n > 0 {
+		last := history[n-1]
+		if last.Rank == item.Rank && last.Total == item.Total && last.Score == item.Score && last.Manual == manual {
+			return nil
+		}
+	}
+
+	history = append(history, ItemSnapshot{
+		Rank:   item.Rank,
+		Total:  item.Total,
+		Score:  item.Score,
+		Time:   time.Now().UTC(),
+		Manual: manual,
+	})
+	if len(history) > historySize {
+		history = history[len(history)-historySize:]
+	}
+
+	value, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+
+	return cache.Put(historyBucket, key, value)
+}
+
+// historyHandler returns the recorded snapshots of an item, oldest first. Numeric
+// ids are looked up in their canonical form, string ids as they are.
+func historyHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := url.PathUnescape(c.Param("id"))
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		} else if id == "" || len(id) > maxTokenLength {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("the id must be between 1 and %d characters", maxTokenLength))
+		} else if num, err := strconv.Atoi(id); err == nil {
+			id = strconv.Itoa(num)
+		}
+
+		history, err := getHistory(cache, cacheKey(c.Param("collection"), id))
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, history)
+	}
+}
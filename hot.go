@@ -0,0 +1,79 @@
+// This file contains the background refresher keeping the most requested items fresh
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// hotRefreshCount is how many of the most requested items get re-fetched
+	// every hotRefreshInterval, 0 disables the refresher
+	hotRefreshCount    = GetenvIntOrDefault("RARITYMON_HOT_REFRESH_COUNT", 0)
+	hotRefreshInterval = GetenvDurationOrDefault("RARITYMON_HOT_REFRESH_INTERVAL", 10*time.Minute)
+
+	hotItems = &hotTracker{hits: make(map[hotKey]int)}
+)
+
+type hotKey struct {
+	collection string
+	id         int
+}
+
+// hotTracker counts item requests between refresher runs
+type hotTracker struct {
+	mu   sync.Mutex
+	hits map[hotKey]int
+}
+
+func (h *hotTracker) record(collection string, id int) {
+	if hotRefreshCount <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	h.hits[hotKey{collection, id}]++
+	h.mu.Unlock()
+}
+
+// take returns the n most requested keys and starts counting afresh
+func (h *hotTracker) take(n int) []hotKey {
+	h.mu.Lock()
+	hits := h.hits
+	h.hits = make(map[hotKey]int)
+	h.mu.Unlock()
+
+	keys := make([]hotKey, 0, len(hits))
+	for key := range hits {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return hits[keys[i]] > hits[keys[j]] })
+
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+func runHotRefresher(cache Cache) {
+	if hotRefreshCount <= 0 || readOnly {
+		return
+	}
+
+	for range time.Tick(hotRefreshInterval) {
+		keys := hotItems.take(hotRefreshCount)
+
+		for _, key := range keys {
+			if _, _, err := fetchAndCache(context.Background(), cache, key.collection, key.id); err != nil {
+				log.Printf("hot refresh %s/%d: %v\n", key.collection, key.id, err)
+			}
+		}
+
+		if len(keys) > 0 {
+			log.Printf("hot refresh: refreshed %d items\n", len(keys))
+		}
+	}
+}
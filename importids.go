@@ -0,0 +1,166 @@
+// This file contains the import of known item ids, warming the cache with exactly
+// those items instead of crawling whole ranges
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	idImportsMu  sync.Mutex
+	idImports    = make(map[string]*idImportJob)
+	lastIdImport int
+)
+
+type idImportJob struct {
+	ID         string     `json:"id"`
+	Total      int        `json:"total"`
+	Cached     int        `json:"cached"`
+	Fetched    int        `json:"fetched"`
+	Failed     int        `json:"failed"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+type itemRef struct {
+	Collection string `json:"collection"`
+	ID         int    `json:"id"`
+}
+
+// parseItemRef reads a "collection,id" line or a {"collection":..., "id":...} object
+func parseItemRef(line string) (itemRef, error) {
+	ref := itemRef{}
+
+	if strings.HasPrefix(line, "{") {
+		if err := json.Unmarshal([]byte(line), &ref); err != nil {
+			return ref, err
+		}
+	} else {
+		collection, id, ok := strings.Cut(line, ",")
+		if !ok {
+			return ref, errors.New("expected collection,id")
+		}
+
+		num, err := strconv.Atoi(strings.TrimSpace(id))
+		if err != nil {
+			return ref, err
+		}
+		ref = itemRef{strings.TrimSpace(collection), num}
+	}
+
+	if ref.Collection == "" {
+		return ref, errors.New("missing collection")
+	}
+	return ref, nil
+}
+
+// runIdImport fetches every uncached item of refs, waiting out upstream backoffs
+func runIdImport(cache Cache, job *idImportJob, refs []itemRef) {
+	for _, ref := range refs {
+		if getCached(cache, ref.Collection, ref.ID) != nil {
+			idImportsMu.Lock()
+			job.Cached++
+			idImportsMu.Unlock()
+			continue
+		}
+
+		var err error
+		for attempt := 0; attempt < 2; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+			_, _, err = fetchAndCache(ctx, cache, ref.Collection, ref.ID)
+			cancel()
+
+			if err != ErrorUpstreamBackoff {
+				break
+			}
+			time.Sleep(backoffRemaining())
+		}
+
+		idImportsMu.Lock()
+		if err != nil {
+			job.Failed++
+		} else {
+			job.Fetched++
+		}
+		idImportsMu.Unlock()
+
+		if err != nil {
+			log.Printf("import ids %s: failed to fetch %s/%d: %v\n", job.ID, ref.Collection, ref.ID, err)
+		}
+	}
+
+	idImportsMu.Lock()
+	now := time.Now()
+	job.FinishedAt = &now
+	idImportsMu.Unlock()
+
+	log.Printf("import ids %s: finished (%d fetched, %d failed)\n", job.ID, job.Fetched, job.Failed)
+}
+
+// importIdsHandler reads a list of known items, one per line, and fetches the
+// uncached ones in the background
+func importIdsHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if readOnly {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "imports are disabled on a read-only instance")
+		}
+
+		refs := []itemRef{}
+		scanner := bufio.NewScanner(c.Request().Body)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+
+			ref, err := parseItemRef(text)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("line %d: %v", line, err))
+			}
+			refs = append(refs, ref)
+		}
+
+		if err := scanner.Err(); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		if len(refs) > maxCrawl {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%d items exceeds the maximum crawl size of %d", len(refs), maxCrawl))
+		}
+
+		idImportsMu.Lock()
+		lastIdImport++
+		job := &idImportJob{ID: strconv.Itoa(lastIdImport), Total: len(refs), StartedAt: time.Now()}
+		idImports[job.ID] = job
+		snapshot := *job
+		idImportsMu.Unlock()
+
+		go runIdImport(cache, job, refs)
+
+		return c.JSON(http.StatusAccepted, snapshot)
+	}
+}
+
+func idImportStatusHandler(c echo.Context) error {
+	idImportsMu.Lock()
+	defer idImportsMu.Unlock()
+
+	job, ok := idImports[c.Param("job")]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "no such import")
+	}
+
+	return c.JSON(http.StatusOK, job)
+}
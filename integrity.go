@@ -0,0 +1,167 @@
+// This file contains the integrity check, which re-scrapes a random sample of the
+// cached items to catch RarityMon changing its markup under the parser
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+var (
+	// integritySampleRate is the share of the cached items re-scraped every
+	// integrityInterval, such as 0.01 for 1%, 0 disables the check. The fresh
+	// parses are only compared, never cached.
+	integritySampleRate = GetenvFloatOrDefault("RARITYMON_INTEGRITY_SAMPLE_RATE", 0)
+	integrityInterval   = GetenvDurationOrDefault("RARITYMON_INTEGRITY_INTERVAL", time.Hour)
+
+	// integrityRand is only used by runIntegrityCheck's goroutine
+	integrityRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// integrityMismatch is a field of a cached item its re-scrape disagrees with.
+// Sentinel mismatches are fields the parser no longer finds, the likeliest sign
+// of a markup change.
+type integrityMismatch struct {
+	field    string
+	sentinel bool
+	cached   interface{}
+	fresh    interface{}
+}
+
+// compareItems lists the fields fresh disagrees with cached on
+func compareItems(cached, fresh *Item) []integrityMismatch {
+	var mismatches []integrityMismatch
+	add := func(field string, lost bool, cachedVal, freshVal interface{}) {
+		mismatches = append(mismatches, integrityMismatch{field, lost, cachedVal, freshVal})
+	}
+
+	if cached.Name != fresh.Name {
+		add("name", fresh.Name == "", cached.Name, fresh.Name)
+	}
+	if cached.Rank != fresh.Rank || cached.Total != fresh.Total {
+		add("rank", fresh.Rank == -1, fmt.Sprintf("%d/%d", cached.Rank, cached.Total), fmt.Sprintf("%d/%d", fresh.Rank, fresh.Total))
+	}
+	if cached.Score != fresh.Score {
+		add("score", fresh.Score == -1, cached.Score, fresh.Score)
+	}
+
+	if len(cached.Traits) != len(fresh.Traits) {
+		add("traits", len(fresh.Traits) == 0, len(cached.Traits), len(fresh.Traits))
+	} else {
+		for key, trait := range cached.Traits {
+			if freshTrait, ok := fresh.Traits[key]; !ok || freshTrait.Name != trait.Name || freshTrait.Tier != trait.Tier || freshTrait.Percentage != trait.Percentage {
+				add("traits", false, trait, freshTrait)
+				break
+			}
+		}
+	}
+
+	return mismatches
+}
+
+// sampleCached picks about integritySampleRate of the scraped cache entries,
+// manual and pinned entries having no scraped page to compare against
+func sampleCached(cache Cache) ([]hotKey, error) {
+	var sample []hotKey
+
+	err := cache.ForEach(cacheBucket, func(k, v []byte) error {
+		if integrityRand.Float64() >= integritySampleRate {
+			return nil
+		}
+
+		entry := decodeEntry(v)
+		if entry.Collection != "" && entry.Token == "" && !entry.Manual && !entry.Pinned {
+			sample = append(sample, hotKey{entry.Collection, entry.ID})
+		}
+		return nil
+	})
+
+	return sample, err
+}
+
+// checkIntegrity re-scrapes an item and compares it with its cached copy. It
+// reports whether the two matched, which items read from a listing always do
+// since their page was never parsed.
+func checkIntegrity(cache Cache, key hotKey) (bool, error) {
+	encodedJson := getCached(cache, key.collection, key.id)
+	if encodedJson == nil {
+		return true, nil
+	}
+
+	cached := &Item{}
+	if err := json.Unmarshal(encodedJson, cached); err != nil {
+		return false, err
+	}
+	for _, warning := range cached.Warnings {
+		if warning == listingWarning {
+			return true, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+
+	fresh, _, err := fetchAndParse(ctx, key.collection, key.id, &fetchTiming{})
+	if err != nil {
+		return false, err
+	}
+
+	mismatches := compareItems(cached, fresh)
+	for _, mismatch := range mismatches {
+		kind := "changed"
+		if mismatch.sentinel {
+			kind = "sentinel"
+			log.Printf("integrity %s/%d: %s is no longer parsed, cached %v\n", key.collection, key.id, mismatch.field, mismatch.cached)
+		} else {
+			log.Printf("integrity %s/%d: %s changed from %v to %v\n", key.collection, key.id, mismatch.field, mismatch.cached, mismatch.fresh)
+		}
+		integrityDiffs.Inc(mismatch.field, kind)
+	}
+
+	return len(mismatches) == 0, nil
+}
+
+// runIntegrityCheck re-scrapes a sample of the cache every integrityInterval.
+// The fetches hold fetch and collection slots like any other, and a run stops
+// early when RarityMon asks us to back off.
+func runIntegrityCheck(cache Cache) {
+	if integritySampleRate <= 0 || integrityInterval <= 0 || readOnly {
+		return
+	}
+
+	for range time.Tick(integrityInterval) {
+		sample, err := sampleCached(cache)
+		if err != nil {
+			log.Printf("integrity: %v\n", err)
+			continue
+		}
+
+		mismatched := 0
+		for _, key := range sample {
+			if backoffRemaining() > 0 {
+				log.Println("integrity: stopping the run while backing off")
+				break
+			}
+
+			matched, err := checkIntegrity(cache, key)
+			switch {
+			case err != nil:
+				integrityChecks.Inc("error")
+				log.Printf("integrity %s/%d: %v\n", key.collection, key.id, err)
+			case matched:
+				integrityChecks.Inc("match")
+			default:
+				integrityChecks.Inc("mismatch")
+				mismatched++
+			}
+		}
+
+		if len(sample) > 0 {
+			log.Printf("integrity: checked %d items, %d mismatched\n", len(sample), mismatched)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+// This file contains the handler serving single items
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// refreshPolicy controls what ?refresh=true does on the item route:
+//
+//	bypass      skip the cache and always refetch, overwriting the cached copy
+//	revalidate  refetch, only overwriting the cached copy when it changed and
+//	            falling back to it when the refetch fails
+//	ignore      the flag is ignored and the cache is always used
+var refreshPolicy = GetenvOrDefault("RARITYMON_REFRESH_POLICY", "bypass")
+
+// minRefreshInterval is how long after a refresh further ?refresh=true requests
+// for the same item are served from the cache, unless they carry the admin key
+var minRefreshInterval = GetenvDurationOrDefault("RARITYMON_MIN_REFRESH_INTERVAL", 0)
+
+// defaultCollection is served by the short /api/item/:id route
+var defaultCollection = GetenvOrDefault("RARITYMON_DEFAULT_COLLECTION", "")
+
+// revalidateKey is the context key the cached copy being revalidated is passed under
+const revalidateKey = "revalidate"
+
+// requestedEntry returns the cache entry naming the requested item, by its id,
+// or by its string id when the token route set tokenKey
+func requestedEntry(c echo.Context) (cacheEntry, error) {
+	collection := c.Param("collection")
+	if token, ok := c.Get(tokenKey).(string); ok {
+		return cacheEntry{Collection: collection, Token: token}, nil
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	return cacheEntry{Collection: collection, ID: id}, err
+}
+
+func cacheMiddleware(cache Cache) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			requested, err := requestedEntry(c)
+
+			if err != nil {
+				return next(c)
+			}
+			collection := requested.Collection
+
+			// only numeric ids have neighbours to prefetch or a place in the hot set
+			if requested.Token == "" {
+				hotItems.record(collection, requested.ID)
+				prefetchAfter(cache, collection, requested.ID)
+			}
+
+			entry, ok := getEntryByKey(cache, requested.key())
+
+			if !ok {
+				return next(c)
+			}
+			jsonReturn := entry.Item
+
+			// a refetch that won't fit in the latency budget is skipped, serving
+			// the cached copy even though it may be slightly stale
+			budget, _ := requestMaxLatency(c)
+
+			if refresh, _ := strconv.ParseBool(c.QueryParam("refresh")); refresh && !readOnly && !entry.Pinned && fitsLatency(budget) {
+				if refreshThrottled(c, entry) {
+					c.Response().Header().Set("X-Refresh-Throttled", "true")
+				} else {
+					switch refreshPolicy {
+					case "bypass":
+						return refreshItem(c, next, cache, requested)
+					case "revalidate":
+						c.Set(revalidateKey, jsonReturn)
+						return refreshItem(c, next, cache, requested)
+					}
+				}
+			}
+
+			// expired items are revalidated, keeping the cached copy if that fails
+			if entryExpired(collection, entry) && !readOnly && fitsLatency(budget) {
+				c.Set(revalidateKey, jsonReturn)
+				return next(c)
+			}
+
+			c.Set(cacheResultKey, "hit")
+			cacheResults.Inc("hit")
+			describeEntry(c, entry)
+
+			if entry.gzipped != nil && acceptsGzip(c) && plainItemRequest(c) {
+				return respondGzipped(c, entry.gzipped)
+			}
+
+			return respondItem(c, cache, jsonReturn, responseMeta{CacheHit: true})
+		}
+	}
+}
+
+// refreshThrottled reports whether a refresh of the entry comes too soon after
+// the last one. Requests with the admin key are never throttled.
+func refreshThrottled(c echo.Context, entry cacheEntry) bool {
+	if minRefreshInterval <= 0 || entry.RefreshedAt == nil || time.Since(*entry.RefreshedAt) >= minRefreshInterval {
+		return false
+	}
+
+	return !keyMatches(requestKey(c), adminKey)
+}
+
+// refreshItem refetches an item through the handler, recording the refresh
+// against minRefreshInterval whether or not it succeeded
+func refreshItem(c echo.Context, next echo.HandlerFunc, cache Cache, requested cacheEntry) error {
+	err := next(c)
+
+	if minRefreshInterval > 0 {
+		if err := markRefreshed(cache, requested.key()); err != nil {
+			log.Printf("refresh %s: %v\n", requested.name(), err)
+		}
+	}
+	return err
+}
+
+// withDefaultCollection fills in the collection parameter for the short item route
+func withDefaultCollection(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if defaultCollection == "" {
+			return echo.NewHTTPError(http.StatusNotFound, "no default collection is configured, use /api/:collection/:id")
+		}
+
+		id := c.Param("id")
+		c.SetParamNames("collection", "id")
+		c.SetParamValues(defaultCollection, id)
+		return next(c)
+	}
+}
+
+// requestUpstreamTimeout reads ?upstreamTimeout=, falling back to the server default
+func requestUpstreamTimeout(c echo.Context) (time.Duration, error) {
+	val := c.QueryParam("upstreamTimeout")
+	if val == "" {
+		return upstreamTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(val)
+	if err != nil || timeout <= 0 {
+		return 0, errors.New("upstreamTimeout must be a positive duration such as 30s")
+	}
+	if timeout > maxUpstreamTimeout {
+		return 0, fmt.Errorf("upstreamTimeout may not exceed %s", maxUpstreamTimeout)
+	}
+
+	return timeout, nil
+}
+
+// fetchError turns the error of fetching an item within timeout into a response
+func fetchError(c echo.Context, err error, timeout time.Duration) error {
+	if err == ErrorCollectionNotFound {
+		return echo.NewHTTPError(http.StatusNotFound, errorBody{Message: err.Error(), Code: "collection_not_found"})
+	} else if err == ErrorReadOnly || err == ErrorTombstoned || err == ErrorItemNotFound || err == ErrorNotFound || errors.Is(err, ErrorNodeNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	} else if err == ErrorUpstreamBackoff {
+		c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(backoffRemaining().Seconds())+1))
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	} else if err == ErrorFetchQueueFull {
+		c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(fetchQueueWait.Seconds())+1))
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	} else if errors.Is(err, ErrorUpstreamBudget) {
+		return upstreamBudgetError(err)
+	} else if err == context.DeadlineExceeded {
+		return echo.NewHTTPError(http.StatusGatewayTimeout, "RarityMon didn't respond within "+timeout.String())
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+}
+
+func itemHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		requested, err := requestedEntry(c)
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		timeout, err := requestUpstreamTimeout(c)
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		budget, err := requestMaxLatency(c)
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		stale, revalidating := c.Get(revalidateKey).([]byte)
+
+		if !fitsLatency(budget) {
+			if revalidating {
+				describeEntry(c, storedEntryByKey(cache, requested.key()))
+				return respondItem(c, cache, stale, responseMeta{CacheHit: true})
+			}
+			return latencyBudgetError(budget)
+		}
+		if budget > 0 && budget < timeout {
+			timeout = budget
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+		defer cancel()
+
+		if verify, _ := strconv.ParseBool(c.QueryParam("verify")); verify {
+			ctx = withVerify(ctx)
+		}
+
+		c.Set(cacheResultKey, "miss")
+		cacheResults.Inc("miss")
+
+		if revalidating {
+			return revalidate(ctx, c, cache, requested, stale)
+		}
+
+		var encodedJson []byte
+		var timing fetchTiming
+		if requested.Token != "" {
+			encodedJson, timing, err = fetchTokenAndCache(ctx, cache, requested.Collection, requested.Token)
+		} else {
+			encodedJson, timing, err = fetchAndCache(ctx, cache, requested.Collection, requested.ID)
+		}
+
+		if err == context.DeadlineExceeded && timeout == budget {
+			return latencyBudgetError(budget)
+		} else if err != nil {
+			return fetchError(c, err, timeout)
+		}
+
+		describeEntry(c, storedEntryByKey(cache, requested.key()))
+
+		if warmOnMiss {
+			warmCollection(cache, requested.Collection, encodedJson)
+		}
+
+		return respondItem(c, cache, encodedJson, responseMeta{
+			FetchMs: durationMs(timing.Fetch),
+			ParseMs: durationMs(timing.Parse),
+		})
+	}
+}
+
+// revalidate refetches a cached item, keeping the cached copy if the refetch fails
+func revalidate(ctx context.Context, c echo.Context, cache Cache, requested cacheEntry, stale []byte) error {
+	encodedJson, page, warnings, timing, err := fetchEncoded(ctx, requested)
+
+	if err != nil {
+		log.Printf("revalidate %s: %v, serving the cached copy\n", requested.name(), err)
+		describeEntry(c, storedEntryByKey(cache, requested.key()))
+		return respondItem(c, cache, stale, responseMeta{CacheHit: true})
+	}
+
+	compacted := &bytes.Buffer{}
+	if err := json.Compact(compacted, encodedJson); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if !bytes.Equal(compacted.Bytes(), stale) {
+		requested.Item, requested.ParseWarnings = encodedJson, warnings
+		if err := putCached(cache, requested, page); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	} else if err := markFetched(cache, requested.key()); err != nil {
+		log.Printf("revalidate %s: %v\n", requested.name(), err)
+	}
+
+	describeEntry(c, storedEntryByKey(cache, requested.key()))
+	return respondItem(c, cache, encodedJson, responseMeta{
+		FetchMs: durationMs(timing.Fetch),
+		ParseMs: durationMs(timing.Parse),
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestCachedItemGzip(t *testing.T) {
+	defer func(compress bool, minSize int) { compressCache, compressMinSize = compress, minSize }(compressCache, compressMinSize)
+	compressCache, compressMinSize = true, 0
+
+	cache := newMemoryCache()
+	itemJson := encodeTestItem(t, &Item{TokenID: 1, Name: "Test #1", Rank: 1, Total: 10, Score: 1, Traits: TraitMap{}})
+	if err := putCached(cache, cacheEntry{Collection: "foo", ID: 1, Item: itemJson}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.GET("/api/:collection/:id", func(c echo.Context) error {
+		t.Error("the cached item was fetched")
+		return nil
+	}, cacheMiddleware(cache))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/foo/1", nil)
+	req.Header.Set(echo.HeaderAcceptEncoding, "gzip")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if encoding := rec.Header().Get(echo.HeaderContentEncoding); encoding != "gzip" {
+		t.Fatalf("the cached item was served with Content-Encoding %q, want gzip", encoding)
+	}
+	if rec.Header().Get("X-Raritymon-Fetched-At") == "" {
+		t.Error("the cached item was served without X-Raritymon-Fetched-At")
+	}
+
+	body, err := gunzipBytes(rec.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, itemJson) {
+		t.Errorf("the cached item was served as %s, want %s", body, itemJson)
+	}
+
+	// clients that don't take gzip get the fetch time in the body as well
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/foo/1", nil))
+
+	if rec.Header().Get(echo.HeaderContentEncoding) != "" || !strings.Contains(rec.Body.String(), `"fetchedAt":`) {
+		t.Errorf("the cached item was served as %s to a client not taking gzip", rec.Body)
+	}
+}
@@ -0,0 +1,73 @@
+// This file contains the ?maxLatency= budget, which serves an item from the cache
+// or fails fast instead of waiting on an upstream fetch that won't fit in it
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	// ErrorLatencyBudget is returned when an item isn't cached and fetching it
+	// wouldn't fit in the requested latency budget
+	ErrorLatencyBudget = errors.New("the item isn't cached and fetching it wouldn't fit in maxLatency")
+
+	upstreamLatencyMu sync.Mutex
+	upstreamLatency   time.Duration
+)
+
+// noteUpstreamLatency folds the duration of a successful page fetch into a
+// moving average, weighing recent fetches the most
+func noteUpstreamLatency(took time.Duration) {
+	upstreamLatencyMu.Lock()
+	defer upstreamLatencyMu.Unlock()
+
+	if upstreamLatency == 0 {
+		upstreamLatency = took
+	} else {
+		upstreamLatency = (upstreamLatency*4 + took) / 5
+	}
+}
+
+// requestMaxLatency reads ?maxLatency=, 0 when the request has no budget
+func requestMaxLatency(c echo.Context) (time.Duration, error) {
+	val := c.QueryParam("maxLatency")
+	if val == "" {
+		return 0, nil
+	}
+
+	budget, err := time.ParseDuration(val)
+	if err != nil || budget <= 0 {
+		return 0, errors.New("maxLatency must be a positive duration such as 250ms")
+	}
+	return budget, nil
+}
+
+// fitsLatency reports whether an upstream fetch is expected to finish within
+// budget. It won't while RarityMon asked us to back off, or when recent fetches
+// have been taking longer than the budget.
+func fitsLatency(budget time.Duration) bool {
+	if budget == 0 {
+		return true
+	}
+	if backoffRemaining() > 0 {
+		return false
+	}
+
+	upstreamLatencyMu.Lock()
+	defer upstreamLatencyMu.Unlock()
+	return upstreamLatency <= budget
+}
+
+// latencyBudgetError answers a request whose item couldn't be served in budget
+func latencyBudgetError(budget time.Duration) error {
+	return echo.NewHTTPError(http.StatusServiceUnavailable, errorBody{
+		Message: fmt.Sprintf("%s: %s", ErrorLatencyBudget.Error(), budget),
+		Code:    "latency_budget",
+	})
+}
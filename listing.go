@@ -0,0 +1,172 @@
+// This file contains the crawl of a collection's ranked listing, which shows the
+// rank and score of a whole page of items per request
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// listingCrawl makes crawls read the ranked listing of a collection before
+	// fetching items one by one, which is then only needed for the ids the
+	// listing doesn't cover, or all of them when there's no listing
+	listingCrawl = GetenvBoolOrDefault("RARITYMON_LISTING_CRAWL", false)
+
+	// listingRowSelector is the tag.class of a single item of the listing
+	listingRowSelector = GetenvOrDefault("RARITYMON_LISTING_ROW_SELECTOR", "div.item-card")
+
+	// maxListingPages is the most listing pages a crawl follows
+	maxListingPages = GetenvIntOrDefault("RARITYMON_MAX_LISTING_PAGES", 500)
+
+	RarityMonListingURL = "https://www.raritymon.com/Collection-ranking?collection=%s&page=%d"
+
+	ErrorNoListing = errors.New("the collection has no ranked listing")
+
+	listingIdMatcher = regexp.MustCompile(`[?&]id=(\d+)`)
+)
+
+// listingWarning marks items taken from the listing, a refresh fetches their page
+const listingWarning = "traits: the item was read from the collection listing, which doesn't show them"
+
+// ParseListing extracts the items of a listing page by id. Rows that don't link
+// to an item page are skipped.
+func ParseListing(page string) (items map[int]*Item, err error) {
+	defer recoverParse(&err)
+
+	rootNode := parseHTML(page)
+
+	if err := checkNode(&rootNode); err != nil {
+		return nil, err
+	}
+
+	tag, class, _ := strings.Cut(listingRowSelector, ".")
+	rows := findEvery(rootNode, tag, class)
+
+	items = make(map[int]*Item)
+	for _, row := range rows {
+		link := findFirst(row, "a", "")
+		if link.Error != nil {
+			continue
+		}
+
+		groups := listingIdMatcher.FindStringSubmatch(link.Attrs()["href"])
+		if groups == nil {
+			continue
+		}
+		id, err := strconv.Atoi(groups[1])
+		if err != nil {
+			continue
+		}
+
+		item := &Item{
+			TokenID:  id,
+			Name:     normalizeName(link.FullText()),
+			Rank:     -1,
+			Total:    -1,
+			Score:    -1,
+			Traits:   make(TraitMap),
+			Warnings: []string{listingWarning},
+		}
+
+		if name := findFirst(row, "h3", ""); name.Error == nil {
+			item.Name = normalizeName(name.FullText())
+		}
+		if rank := findFirst(row, "button", "item-rarity-rank"); rank.Error == nil {
+			item.Rank, item.Total = parseRank(rank.FullText())
+			if item.Total > 0 {
+				item.RankedTotal = item.Total
+			}
+		}
+		if score := findFirst(row, "button", "item-trait-data"); score.Error == nil {
+			item.Score = parseRarity(score.FullText())
+		}
+
+		items[id] = item
+	}
+
+	return items, nil
+}
+
+// fetchListingPage downloads and parses a page of the listing, numbered from 1
+func fetchListingPage(collection string, pageNum int, timeout time.Duration) (map[int]*Item, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	release, err := acquireSlots(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	page, err := getPage(ctx, fmt.Sprintf(RarityMonListingURL, collection, pageNum))
+	release()
+
+	if err != nil {
+		return nil, err
+	} else if containsAny(page, collectionMissingMarkers) {
+		return nil, ErrorCollectionNotFound
+	}
+
+	return ParseListing(page)
+}
+
+// crawlListing follows the listing of a collection page by page, caching the
+// uncached items within from-to. It returns every id of the range the listing
+// covered, and ErrorNoListing when its first page holds no items.
+func crawlListing(cache Cache, collection string, from, to int, timeout time.Duration) (map[int]bool, error) {
+	listed := make(map[int]bool)
+	seen := make(map[int]bool)
+
+	for pageNum := 1; pageNum <= maxListingPages; pageNum++ {
+		items, err := fetchListingPage(collection, pageNum, timeout)
+
+		if err == nil && len(items) == 0 && pageNum == 1 {
+			err = ErrorNoListing
+		}
+		if err != nil {
+			if pageNum == 1 {
+				return nil, err
+			}
+			log.Printf("listing %s: stopping at page %d: %v\n", collection, pageNum, err)
+			break
+		}
+
+		// past the last page the listing either runs empty or repeats itself
+		fresh := 0
+		for id, item := range items {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			fresh++
+
+			if id < from || id > to {
+				continue
+			}
+			listed[id] = true
+
+			// the listing only fills in items that aren't cached at all, marked
+			// partial so their page is fetched once they're requested
+			encodedJson, err := json.MarshalIndent(item, " ", "  ")
+			if err == nil {
+				now := time.Now().UTC()
+				err = putEntryIfAbsent(cache, cacheEntry{Collection: collection, ID: id, Item: encodedJson, Partial: true, FetchedAt: &now})
+			}
+			if err != nil {
+				return listed, err
+			}
+		}
+
+		if fresh == 0 {
+			break
+		}
+	}
+
+	return listed, nil
+}
@@ -0,0 +1,79 @@
+// This file contains the maintenance mode pausing traffic without stopping the process
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/labstack/echo/v4"
+)
+
+// maintenance makes every endpoint but /health, /version and the admin ones
+// answer 503. It starts out as RARITYMON_MAINTENANCE and is toggled by SIGUSR1 or
+// set through the admin endpoint. It used to be toggled by SIGHUP, which reloads
+// the cache TTLs instead since those became reloadable, so scripts that sent
+// SIGHUP to pause traffic have to send SIGUSR1 now.
+var maintenance atomic.Bool
+
+func init() {
+	maintenance.Store(GetenvBoolOrDefault("RARITYMON_MAINTENANCE", false))
+}
+
+func maintenanceMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !maintenance.Load() {
+			return next(c)
+		}
+
+		switch path := strings.TrimPrefix(c.Path(), pathPrefix); {
+		case path == "/health", path == "/version", strings.HasPrefix(path, "/admin/"):
+			return next(c)
+		}
+
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "the service is down for maintenance")
+	}
+}
+
+// watchMaintenanceSignal toggles maintenance mode on every SIGUSR1
+func watchMaintenanceSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	for range signals {
+		enabled := !maintenance.Load()
+		maintenance.Store(enabled)
+		log.Printf("maintenance mode %s\n", onOff(enabled))
+	}
+}
+
+func onOff(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
+
+type Maintenance struct {
+	Enabled bool `json:"enabled"`
+}
+
+// maintenanceHandler reports maintenance mode, or sets it with ?enabled=
+func maintenanceHandler(c echo.Context) error {
+	if val := c.QueryParam("enabled"); val != "" {
+		enabled, err := strconv.ParseBool(val)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		maintenance.Store(enabled)
+		log.Printf("maintenance mode %s\n", onOff(enabled))
+	}
+
+	return c.JSON(http.StatusOK, Maintenance{Enabled: maintenance.Load()})
+}
@@ -0,0 +1,179 @@
+// This file contains the service metrics, exposed in the Prometheus text format
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	metricsMu sync.Mutex
+	counters  []*counterVec
+	gauges    []*gaugeFunc
+
+	unbalancedRetries = newCounter("raritymon_unbalanced_retries_total", "Item pages refetched because their trait nodes were unbalanced", "outcome")
+	manualOverrides   = newCounter("raritymon_manual_overrides_total", "Items stored through the admin API instead of being scraped")
+	fetchFailures     = newCounter("raritymon_fetch_failures_total", "Item fetches and parses that failed, by the point they failed at", "reason")
+	handlerPanics     = newCounter("raritymon_handler_panics_total", "Requests whose handler panicked, by route", "route")
+	cacheResults      = newCounter("raritymon_cache_results_total", "Item requests served from the cache (hit) or fetched (miss)", "result")
+	prefetches        = newCounter("raritymon_prefetches_total", "Items following a requested one cached in the background, by whether the fetch succeeded", "outcome")
+	integrityChecks   = newCounter("raritymon_integrity_checks_total", "Cached items re-scraped by the integrity check, by whether they matched", "outcome")
+	integrityDiffs    = newCounter("raritymon_integrity_mismatches_total", "Fields of sampled items that differed from their re-scrape, by field and whether they turned into a sentinel", "field", "kind")
+)
+
+// counterVec is a monotonically increasing counter partitioned by label values
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]uint64
+
+	// base holds the totals of previous runs, loaded by loadStats
+	base map[string]uint64
+}
+
+func newCounter(name, help string, labels ...string) *counterVec {
+	counter := &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]uint64),
+	}
+
+	metricsMu.Lock()
+	counters = append(counters, counter)
+	metricsMu.Unlock()
+
+	return counter
+}
+
+// Inc increments the counter for the given label values, which must match the
+// labels the counter was created with
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterVec) Add(n uint64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+
+	c.mu.Lock()
+	c.values[key] += n
+	c.mu.Unlock()
+}
+
+// snapshot returns the values since startup keyed by their comma joined label values
+func (c *counterVec) snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	values := make(map[string]uint64, len(c.values))
+	for key, value := range c.values {
+		values[strings.ReplaceAll(key, "\x00", ",")] = value
+	}
+	return values
+}
+
+// lifetimeSnapshot is snapshot with the totals of previous runs added in
+func (c *counterVec) lifetimeSnapshot() map[string]uint64 {
+	values := make(map[string]uint64)
+	for key, value := range c.lifetime() {
+		values[strings.ReplaceAll(key, "\x00", ",")] = value
+	}
+	return values
+}
+
+// lifetime returns the totals of previous runs plus the values since startup,
+// keyed as they're stored
+func (c *counterVec) lifetime() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	values := make(map[string]uint64, len(c.base)+len(c.values))
+	for key, value := range c.base {
+		values[key] = value
+	}
+	for key, value := range c.values {
+		values[key] += value
+	}
+	return values
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, key), c.values[key])
+	}
+}
+
+// gaugeFunc is a value sampled whenever the metrics are scraped
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func newGaugeFunc(name, help string, value func() float64) *gaugeFunc {
+	gauge := &gaugeFunc{name, help, value}
+
+	metricsMu.Lock()
+	gauges = append(gauges, gauge)
+	metricsMu.Unlock()
+
+	return gauge
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", g.name, g.help, g.name, g.name, g.value())
+}
+
+func formatLabels(labels []string, key string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	values := strings.Split(key, "\x00")
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=%q", label, value)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func metricsHandler(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4")
+	c.Response().WriteHeader(http.StatusOK)
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	for _, counter := range counters {
+		counter.write(c.Response())
+	}
+	for _, gauge := range gauges {
+		gauge.write(c.Response())
+	}
+	return nil
+}
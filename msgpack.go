@@ -0,0 +1,135 @@
+// This file contains the MessagePack encoding of item responses. Responses are
+// transcoded from their JSON so the two formats can't disagree.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const MIMEApplicationMsgpack = "application/msgpack"
+
+// wantsMsgpack reports whether the request asks for a MessagePack response
+func wantsMsgpack(c echo.Context) bool {
+	accept := c.Request().Header.Get(echo.HeaderAccept)
+	return c.QueryParam("format") == "msgpack" ||
+		strings.Contains(accept, MIMEApplicationMsgpack) || strings.Contains(accept, "application/x-msgpack")
+}
+
+// respondMsgpack writes i as MessagePack, shaped exactly like its JSON response
+func respondMsgpack(c echo.Context, i interface{}) error {
+	body, err := json.Marshal(serializable(c, http.StatusOK, i))
+	if err == nil {
+		body, err = jsonToMsgpack(body)
+	}
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.Blob(http.StatusOK, MIMEApplicationMsgpack, body)
+}
+
+func jsonToMsgpack(body []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	err := writeMsgpack(buf, value)
+	return buf.Bytes(), err
+}
+
+// writeMsgpack encodes a decoded JSON value, numbers without a fraction or
+// exponent as integers and the rest as float64. Map keys are written sorted.
+func writeMsgpack(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			writeMsgpackInt(buf, n)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		writeMsgpackHeader(buf, len(v), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		writeMsgpackHeader(buf, len(v), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := writeMsgpack(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		writeMsgpackHeader(buf, len(v), 0x80, 15, 0, 0xde, 0xdf)
+		for _, key := range keys {
+			writeMsgpack(buf, key)
+			if err := writeMsgpack(buf, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("can't encode %T as MessagePack", value)
+	}
+	return nil
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0 && n <= 127:
+		buf.WriteByte(byte(n))
+	case n < 0 && n >= -32:
+		buf.WriteByte(byte(int8(n)))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// writeMsgpackHeader writes the length of a string, array or map using the fixed
+// format when it fits and the 8 (strings only), 16 or 32 bit one otherwise
+func writeMsgpackHeader(buf *bytes.Buffer, length int, fixed byte, fixedMax int, len8, len16, len32 byte) {
+	switch {
+	case length <= fixedMax:
+		buf.WriteByte(fixed | byte(length))
+	case len8 != 0 && length <= math.MaxUint8:
+		buf.Write([]byte{len8, byte(length)})
+	case length <= math.MaxUint16:
+		buf.WriteByte(len16)
+		binary.Write(buf, binary.BigEndian, uint16(length))
+	default:
+		buf.WriteByte(len32)
+		binary.Write(buf, binary.BigEndian, uint32(length))
+	}
+}
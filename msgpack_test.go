@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// readMsgpack decodes the subset of MessagePack writeMsgpack produces, into the
+// values decodeJSONNumbers turns JSON into
+func readMsgpack(r *bytes.Reader) (interface{}, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	readLength := func(size int) (int, error) {
+		switch size {
+		case 1:
+			n, err := r.ReadByte()
+			return int(n), err
+		case 2:
+			var n uint16
+			err := binary.Read(r, binary.BigEndian, &n)
+			return int(n), err
+		}
+		var n uint32
+		err := binary.Read(r, binary.BigEndian, &n)
+		return int(n), err
+	}
+
+	readString := func(length int) (interface{}, error) {
+		s := make([]byte, length)
+		_, err := io.ReadFull(r, s)
+		return string(s), err
+	}
+
+	readArray := func(length int) (interface{}, error) {
+		values := make([]interface{}, 0, length)
+		for i := 0; i < length; i++ {
+			value, err := readMsgpack(r)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+
+	readMap := func(length int) (interface{}, error) {
+		values := make(map[string]interface{}, length)
+		for i := 0; i < length; i++ {
+			key, err := readMsgpack(r)
+			if err != nil {
+				return nil, err
+			}
+			value, err := readMsgpack(r)
+			if err != nil {
+				return nil, err
+			}
+			values[key.(string)] = value
+		}
+		return values, nil
+	}
+
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xe0 == 0xa0:
+		return readString(int(b & 0x1f))
+	case b&0xf0 == 0x90:
+		return readArray(int(b & 0x0f))
+	case b&0xf0 == 0x80:
+		return readMap(int(b & 0x0f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcb:
+		var bits uint64
+		err := binary.Read(r, binary.BigEndian, &bits)
+		return math.Float64frombits(bits), err
+	case 0xd3:
+		var n int64
+		err := binary.Read(r, binary.BigEndian, &n)
+		return n, err
+	case 0xd9, 0xda, 0xdb:
+		length, err := readLength(map[byte]int{0xd9: 1, 0xda: 2, 0xdb: 4}[b])
+		if err != nil {
+			return nil, err
+		}
+		return readString(length)
+	case 0xdc, 0xdd:
+		length, err := readLength(map[byte]int{0xdc: 2, 0xdd: 4}[b])
+		if err != nil {
+			return nil, err
+		}
+		return readArray(length)
+	case 0xde, 0xdf:
+		length, err := readLength(map[byte]int{0xde: 2, 0xdf: 4}[b])
+		if err != nil {
+			return nil, err
+		}
+		return readMap(length)
+	}
+	return nil, fmt.Errorf("unexpected MessagePack type byte %#x", b)
+}
+
+// decodeJSONNumbers decodes JSON, turning integers into int64 and other numbers
+// into float64 the way writeMsgpack encodes them
+func decodeJSONNumbers(t *testing.T, body []byte) interface{} {
+	t.Helper()
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatal(err)
+	}
+
+	var convert func(interface{}) interface{}
+	convert = func(value interface{}) interface{} {
+		switch v := value.(type) {
+		case json.Number:
+			if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+				return n
+			}
+			f, err := v.Float64()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return f
+		case []interface{}:
+			for i := range v {
+				v[i] = convert(v[i])
+			}
+		case map[string]interface{}:
+			for key := range v {
+				v[key] = convert(v[key])
+			}
+		}
+		return value
+	}
+	return convert(value)
+}
+
+func TestMsgpackMatchesJSON(t *testing.T) {
+	traits := TraitMap{}
+	list := TraitList{}
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("Trait %d", i)
+		trait := Trait{Type: name, Name: strings.Repeat("v", i*10), Tier: "Rare", Percentage: float64(i) / 3}
+		traits[name], list = trait, append(list, trait)
+	}
+
+	responses := []interface{}{
+		itemResponse{Item: &Item{TokenID: 7, Name: "Test #7", Rank: 3, Total: 10, Score: 12.5, Traits: TraitMap{"Hat": {Type: "Hat", Name: "Cap", Tier: "Rare", Percentage: 1.5}}}},
+		itemResponse{Item: &Item{Name: "Unranked", Rank: -1, Total: -1, Score: -1, Traits: TraitMap{}, Warnings: []string{"rank: missing"}}},
+		itemResponse{Item: &Item{TokenID: 1 << 40, Name: strings.Repeat("long ", 20000), Rank: -100000, Traits: traits}, TraitList: list, ComputedRank: 70000},
+		map[string]interface{}{"null": nil, "yes": true, "no": false, "small": -32, "big": math.MaxInt64, "float": 1e300},
+	}
+
+	for i, response := range responses {
+		body, err := json.Marshal(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		packed, err := jsonToMsgpack(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reader := bytes.NewReader(packed)
+		unpacked, err := readMsgpack(reader)
+		if err != nil {
+			t.Fatalf("response %d: %v", i, err)
+		}
+		if reader.Len() != 0 {
+			t.Errorf("response %d: %d bytes left after the value", i, reader.Len())
+		}
+
+		if want := decodeJSONNumbers(t, body); !reflect.DeepEqual(unpacked, want) {
+			t.Errorf("response %d: MessagePack decoded to\n%v\nJSON to\n%v", i, unpacked, want)
+		}
+	}
+}
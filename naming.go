@@ -0,0 +1,168 @@
+// This file contains the JSON field naming applied to every response
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+)
+
+// jsonCase selects how struct fields are named in responses, either "camel" (the
+// names the struct tags use) or "snake". Map keys such as trait types are data
+// and are never renamed.
+var jsonCase = GetenvOrDefault("RARITYMON_JSON_CASE", "camel")
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	itemType          = reflect.TypeOf(Item{})
+)
+
+// responseSerializer wraps responses in the envelope when it's enabled and
+// renames struct fields according to jsonCase before encoding
+type responseSerializer struct {
+	echo.DefaultJSONSerializer
+}
+
+func (s responseSerializer) Serialize(c echo.Context, i interface{}, indent string) error {
+	return s.DefaultJSONSerializer.Serialize(c, serializable(c, c.Response().Status, i), indent)
+}
+
+// serializable wraps i in the envelope when it's enabled, renames its fields
+// according to jsonCase and leaves out the item fields hidden from the request,
+// ready for the standard encoder
+func serializable(c echo.Context, status int, i interface{}) interface{} {
+	if responseEnvelope {
+		wrapped := envelop(status, i)
+		if complete, ok := c.Get(crawlCompleteKey).(bool); ok {
+			wrapped.Complete = &complete
+		}
+		i = wrapped
+	}
+	if hidden := hiddenFields(c); jsonCase == "snake" || hidden != nil {
+		i = snakeCaseValue(reflect.ValueOf(i), hidden)
+	}
+	return i
+}
+
+// jsonFieldName applies jsonCase to a field name taken from a struct tag
+func jsonFieldName(name string) string {
+	if jsonCase != "snake" {
+		return name
+	}
+
+	out := strings.Builder{}
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				out.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+// snakeCaseValue converts v into maps and slices the standard encoder will write
+// with field names according to jsonCase, leaving out the hidden fields of items
+func snakeCaseValue(v reflect.Value, hidden map[string]bool) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+
+	if v.Type().Implements(jsonMarshalerType) {
+		return v.Interface()
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return snakeCaseValue(v.Elem(), hidden)
+	case reflect.Struct:
+		fields := make(map[string]interface{})
+		snakeCaseFields(v, fields, hidden)
+		return fields
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		out := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out[fmt.Sprint(iter.Key().Interface())] = snakeCaseValue(iter.Value(), hidden)
+		}
+		return out
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Interface()
+		}
+		fallthrough
+	case reflect.Array:
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			out[i] = snakeCaseValue(v.Index(i), hidden)
+		}
+		return out
+	}
+
+	return v.Interface()
+}
+
+func snakeCaseFields(v reflect.Value, fields map[string]interface{}, hidden map[string]bool) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		value := v.Field(i)
+
+		tag := field.Tag.Get("json")
+		name, options, _ := strings.Cut(tag, ",")
+
+		if field.Anonymous && name == "" {
+			for value.Kind() == reflect.Pointer {
+				if value.IsNil() {
+					break
+				}
+				value = value.Elem()
+			}
+			if value.Kind() == reflect.Struct {
+				snakeCaseFields(value, fields, hidden)
+			}
+			continue
+		}
+
+		if !field.IsExported() || name == "-" || (v.Type() == itemType && hidden[name]) {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.Contains(options, "omitempty") && isEmptyJSONValue(value) {
+			continue
+		}
+
+		fields[jsonFieldName(name)] = snakeCaseValue(value, hidden)
+	}
+}
+
+// isEmptyJSONValue mirrors what encoding/json considers empty for omitempty
+func isEmptyJSONValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
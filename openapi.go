@@ -0,0 +1,417 @@
+// This file contains the OpenAPI description of the service. Paths come from the
+// registered echo routes and schemas are reflected from the response structs, so
+// the document can't drift from the code.
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var pathParamMatcher = regexp.MustCompile(`:(\w+)`)
+
+type apiParam struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+// apiOperation documents a route beyond what can be inferred from its path
+type apiOperation struct {
+	Summary     string
+	Query       []apiParam
+	Status      int
+	ContentType string
+	Response    interface{}
+}
+
+// errorBody is the shape every error is rendered in, see handleError. Code is
+// only set on the errors clients are expected to tell apart, Missing on
+// incomplete_item ones.
+type errorBody struct {
+	Message string   `json:"message"`
+	Code    string   `json:"code,omitempty"`
+	Missing []string `json:"missing,omitempty"`
+	Path    string   `json:"path,omitempty"`
+}
+
+var rangeParams = []apiParam{
+	{"from", "integer", "First id of the range (defaults to 1)"},
+	{"to", "integer", "Last id of the range, inclusive"},
+	upstreamTimeoutParam,
+}
+
+var waitForCompleteParam = apiParam{"waitForComplete", "boolean", "Answer 425 with a Retry-After while a crawl of the collection is running, instead of the partial data marked by complete: false and X-Crawl-Complete: false"}
+
+var upstreamTimeoutParam = apiParam{"upstreamTimeout", "string", "How long to wait for each RarityMon page, as a duration such as 30s, up to the server's maximum"}
+
+var apiOperations = map[string]apiOperation{
+	"GET /api/:collection/:id": {
+		Summary: "Fetch a single item, served from the cache when possible. Non-fatal parse warnings are listed in the X-Raritymon-Warnings header and the time it was scraped in X-Raritymon-Fetched-At",
+		Query: []apiParam{
+			{"timing", "boolean", "Include a _meta object describing cache use and upstream timings"},
+			{"refresh", "boolean", "Refetch the item, subject to the server's refresh policy. Within the server's minimum refresh interval of the last refresh the cached copy is served with X-Refresh-Throttled: true, unless the admin key is sent"},
+			{"maxLatency", "string", "Latency budget as a duration such as 250ms. When fetching the item wouldn't fit in it, a cached copy is served as is, possibly slightly stale by design, and an uncached item answers 503 right away"},
+			{"verify", "boolean", "When the item is fetched, read its page twice and add a warning if the reads disagree on rank, score or trait count"},
+			{"enrich", "boolean", "Attach the collection page data, taking the supply from it when the item page doesn't show one"},
+			{"format", "string", "Set to xml for an XML response, as does Accept: application/xml, or to msgpack for a MessagePack one shaped like the JSON, as does Accept: application/msgpack"},
+			{"traitSort", "string", "Return the traits as a traitList sorted by percentage, rarest first, or by type, along with the rarestTrait"},
+			{"group", "string", "Return the traits as traitGroups nested by tier or percentage band (<1%, 1-5%, 5-10%, 10-25%, 25-50%, >=50%)"},
+			{"dropNone", "boolean", "Leave out the traits valued None, or one of the server's configured none values"},
+			{"require", "string", "Comma separated fields of rank, score, traits and name the item must have. When the parsed item is missing any of them, 422 incomplete_item lists them in missing instead of returning a partial item"},
+			{"ordinal", "boolean", "Add the rank formatted for display as ordinalRank, such as \"23rd / 1000\", left out when the item isn't ranked"},
+			{"computeRank", "boolean", "When RarityMon doesn't rank the item yet, add a computedRank from its score among the cached items of the collection"},
+			{"basisPoints", "boolean", "Add each trait's percentage as an integer number of basis points in basisPoints, 12.34% being 1234"},
+			{"traitOffset", "integer", "Skip this many traits, ordered by type"},
+			{"traitLimit", "integer", "Return at most this many traits, 0 or unset returns all of them"},
+			upstreamTimeoutParam,
+		},
+		Response: itemResponse{},
+	},
+	"GET /api/:collection/token/:id": {
+		Summary:  "Fetch a single item by a string id, for collections whose ids aren't numbers, accepting the same options. Numeric ids are served as by /api/:collection/:id",
+		Response: itemResponse{},
+	},
+	"HEAD /api/:collection/:id": {
+		Summary: "Check a cached item without fetching it, accepting the same options apart from enrich. Sends the headers of the GET, Content-Length, ETag and Cache-Control included, 304 when If-None-Match holds the ETag, and 404 or the server's configured status when the item isn't cached",
+	},
+	"HEAD /api/:collection/token/:id": {
+		Summary: "Check a cached item by a string id without fetching it, like HEAD /api/:collection/:id",
+	},
+	"HEAD /api/item/:id": {
+		Summary: "Check a cached item of the configured default collection without fetching it, like HEAD /api/:collection/:id",
+	},
+	"GET /api/item/:id": {
+		Summary:  "Fetch a single item of the configured default collection, accepting the same options",
+		Response: itemResponse{},
+	},
+	"GET /api/:collection": {
+		Summary:  "Fetch a range of items keyed by id",
+		Query:    append([]apiParam{waitForCompleteParam}, rangeParams...),
+		Response: map[string]Item{},
+	},
+	"GET /api/:collection/crawl": {
+		Summary:  "Report the progress of the running crawl",
+		Response: crawlJob{},
+	},
+	"POST /api/:collection/crawl": {
+		Summary:  "Start a background crawl caching a range of items, skipped with a 200 when the collection total hasn't changed since the last complete crawl",
+		Query:    append([]apiParam{{"force", "boolean", "Crawl even if the collection total hasn't changed"}}, rangeParams...),
+		Status:   http.StatusAccepted,
+		Response: crawlJob{},
+	},
+	"GET /api/:collection/scan": {
+		Summary:     "Report which ids of a range resolve to items, one JSON object per line as they're checked",
+		Query:       rangeParams,
+		ContentType: "application/x-ndjson",
+		Response:    ScanResult{},
+	},
+	"GET /api/:collection/thresholds": {
+		Summary:  "Scores needed to reach the top 10, 100, 1000 and 10000, computed from cached items",
+		Query:    []apiParam{waitForCompleteParam},
+		Response: Thresholds{},
+	},
+	"GET /api/:collection/distribution": {
+		Summary: "Histogram of the scores of the cached items, in bins of equal width between the lowest and highest score",
+		Query: []apiParam{
+			{"bins", "integer", "Number of bins, defaults to the server's setting"},
+			waitForCompleteParam,
+		},
+		Response: Distribution{},
+	},
+	"GET /api/:collection/:id/history": {
+		Summary:  "Rank and score snapshots recorded whenever a fetch changed them, oldest first. The id may also be the string id of a token route item.",
+		Response: []ItemSnapshot{},
+	},
+	"GET /api/:collection/:id/rank": {
+		Summary: "Fetch only the rank and total of an item, projected from the cached item when there is one",
+		Query: []apiParam{
+			{"light", "boolean", "On a cache miss, read only the rank button off the page instead of parsing the whole item. Nothing is cached, so the next request fetches the page again."},
+			upstreamTimeoutParam,
+		},
+		Response: RankInfo{},
+	},
+	"GET /api/:collection/:id/similar": {
+		Summary: "Find the cached items sharing the most traits with an item",
+		Query: []apiParam{
+			{"limit", "integer", "Most items to return (defaults to 10)"},
+		},
+		Response: []SimilarItem{},
+	},
+	"GET /admin/collections": {
+		Summary:  "List every known collection with its cached item count and last crawl",
+		Response: []CollectionSummary{},
+	},
+	"DELETE /admin/cache/:collection": {
+		Summary:  "Flush every cached item of a collection along with its pages, history and markers",
+		Response: map[string]int{},
+	},
+	"DELETE /admin/cache/:collection/:id": {
+		Summary: "Evict an item, optionally keeping it from being refetched",
+		Query: []apiParam{
+			{"tombstone", "string", "Duration (e.g. 6h) during which the item is answered with 404 instead of refetched"},
+		},
+		Status: http.StatusNoContent,
+	},
+	"GET /admin/cache/export": {
+		Summary:     "Dump every cache entry, one JSON object per line",
+		ContentType: "application/x-ndjson",
+		Response:    cacheEntry{},
+	},
+	"POST /admin/cache/import": {
+		Summary:  "Load a dump produced by the export endpoint",
+		Response: map[string]int{},
+	},
+	"GET /metrics": {
+		Summary:     "Service metrics in the Prometheus text format",
+		ContentType: "text/plain",
+		Response:    "",
+	},
+	"GET /health": {
+		Summary:  "Report the health of the instance and its storage",
+		Response: Health{},
+	},
+	"POST /admin/cache/check": {
+		Summary:  "Decode every cached item, reporting the ones that fail",
+		Query:    []apiParam{{"repair", "boolean", "Delete the entries that fail to decode"}},
+		Response: CacheCheck{},
+	},
+	"POST /admin/cache/reparse": {
+		Summary:  "Parse the stored pages of the cached items again, for RARITYMON_KEEP_PAGES instances",
+		Response: CacheReparse{},
+	},
+	"POST /admin/import-ids": {
+		Summary:  "Fetch the uncached items of a list of collection,id lines, or collection/id JSON objects, in the background",
+		Status:   http.StatusAccepted,
+		Response: idImportJob{},
+	},
+	"GET /admin/import-ids/:job": {
+		Summary:  "Report the progress of an id import",
+		Response: idImportJob{},
+	},
+	"GET /debug/key/:collection/:id": {
+		Summary:  "Compute the hex encoded key an item, by a numeric or string id, is stored under and the prefix shared by its collection, along with the collection, id and parser version they are hashed from, for inspecting the database with bolt tooling",
+		Response: CacheKey{},
+	},
+	"PUT /admin/:collection/:id": {
+		Summary:  "Store an Item as the cached value of an item, marked as a manual override",
+		Query:    []apiParam{{"pin", "boolean", "Keep refetches from replacing the item"}},
+		Response: Item{},
+	},
+	"PUT /admin/cache/:collection/:id": {
+		Summary:  "Same as PUT /admin/:collection/:id",
+		Query:    []apiParam{{"pin", "boolean", "Keep refetches from replacing the item"}},
+		Response: Item{},
+	},
+	"PUT /admin/cache/:collection/:id/pin": {
+		Summary: "Pin a cached item so refreshes, the hot refresher and reparses leave it as it is",
+		Status:  http.StatusNoContent,
+	},
+	"DELETE /admin/cache/:collection/:id/pin": {
+		Summary: "Unpin a cached item",
+		Status:  http.StatusNoContent,
+	},
+	"GET /version": {
+		Summary:  "Report the version of the running build",
+		Response: Version{},
+	},
+	"GET /admin/maintenance": {
+		Summary:  "Report whether maintenance mode is on",
+		Response: Maintenance{},
+	},
+	"PUT /admin/maintenance": {
+		Summary:  "Turn maintenance mode on or off, every endpoint but /health, /version and the admin ones answers 503 while it's on. Sending the process SIGUSR1 toggles it as well",
+		Query:    []apiParam{{"enabled", "boolean", "Whether maintenance mode should be on"}},
+		Response: Maintenance{},
+	},
+	"GET /stats": {
+		Summary:  "Summarise the service counters, such as fetch failures by reason",
+		Response: Stats{},
+	},
+	"POST /rpc": {
+		Summary:  "Serve a JSON-RPC 2.0 call or batch of calls. getItem takes a collection and an id and returns the item.",
+		Response: []rpcResponse{},
+	},
+	"GET /openapi.json": {
+		Summary: "This document",
+	},
+}
+
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+func (b *schemaBuilder) schemaFor(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schemaFor(t.Elem())}
+	case reflect.Struct:
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := b.components[name]; !ok {
+			// reserve the name first so self referencing structs terminate
+			b.components[name] = nil
+			b.components[name] = b.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+
+	return map[string]interface{}{}
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		if field.Anonymous && field.Tag.Get("json") == "" {
+			// embedded structs are flattened into the parent by encoding/json
+			embedded := field.Type
+			for embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			for name, schema := range b.structSchema(embedded)["properties"].(map[string]interface{}) {
+				properties[name] = schema
+			}
+			continue
+		}
+
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("json"); ok {
+			tagName := strings.Split(tag, ",")[0]
+			if tagName == "-" {
+				continue
+			} else if tagName != "" {
+				name = tagName
+			}
+		}
+
+		properties[jsonFieldName(name)] = b.schemaFor(field.Type)
+	}
+
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// buildOpenAPISpec describes every route registered on e
+func buildOpenAPISpec(e *echo.Echo) map[string]interface{} {
+	builder := &schemaBuilder{components: make(map[string]interface{})}
+	paths := make(map[string]map[string]interface{})
+
+	routes := e.Routes()
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Path < routes[j].Path })
+
+	// the catch-all routes echo adds for group middleware aren't real operations
+	notFound := runtime.FuncForPC(reflect.ValueOf(echo.NotFoundHandler).Pointer()).Name()
+
+	for _, route := range routes {
+		if route.Name == notFound {
+			continue
+		}
+
+		op := apiOperations[route.Method+" "+strings.TrimPrefix(route.Path, pathPrefix)]
+
+		status := op.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		contentType := op.ContentType
+		if contentType == "" {
+			contentType = echo.MIMEApplicationJSON
+		}
+
+		success := map[string]interface{}{"description": http.StatusText(status)}
+		if op.Response != nil {
+			success["content"] = map[string]interface{}{
+				contentType: map[string]interface{}{"schema": builder.schemaFor(reflect.TypeOf(op.Response))},
+			}
+		}
+
+		parameters := []interface{}{}
+		for _, match := range pathParamMatcher.FindAllStringSubmatch(route.Path, -1) {
+			parameters = append(parameters, map[string]interface{}{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, param := range op.Query {
+			parameters = append(parameters, map[string]interface{}{
+				"name":        param.Name,
+				"in":          "query",
+				"description": param.Description,
+				"schema":      map[string]interface{}{"type": param.Type},
+			})
+		}
+
+		path := pathParamMatcher.ReplaceAllString(route.Path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(route.Method)] = map[string]interface{}{
+			"summary":    op.Summary,
+			"parameters": parameters,
+			"responses": map[string]interface{}{
+				strconv.Itoa(status): success,
+				"default":            map[string]interface{}{"$ref": "#/components/responses/Error"},
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "RarityMon API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": builder.components,
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "The request failed",
+					"content": map[string]interface{}{
+						echo.MIMEApplicationJSON: map[string]interface{}{"schema": builder.schemaFor(reflect.TypeOf(errorBody{}))},
+					},
+				},
+			},
+		},
+	}
+}
+
+func openAPIHandler(e *echo.Echo) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, buildOpenAPISpec(e))
+	}
+}
@@ -0,0 +1,125 @@
+// This file contains the choice of HTML parser. soup is the default, the html
+// parser walks the golang.org/x/net/html tree itself for pages soup mishandles.
+// Both hand out soup.Root nodes, which only wrap an *html.Node, so the parsing
+// of items doesn't depend on which one is in use.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/anaskhan96/soup"
+	"golang.org/x/net/html"
+)
+
+// htmlParser is either soup or html
+var htmlParser = GetenvOrDefault("RARITYMON_PARSER", "soup")
+
+// parseHTML parses a page, returning its first element
+func parseHTML(page string) soup.Root {
+	if htmlParser == "soup" {
+		return soup.HTMLParse(page)
+	}
+
+	node, err := html.Parse(strings.NewReader(page))
+	if err != nil {
+		return soup.Root{Error: fmt.Errorf("unable to parse the HTML: %w", err)}
+	}
+
+	for node != nil && node.Type != html.ElementNode {
+		if node.Type == html.DocumentNode {
+			node = node.FirstChild
+		} else {
+			node = node.NextSibling
+		}
+	}
+	if node == nil {
+		return soup.Root{Error: errors.New("the page has no elements")}
+	}
+	return soup.Root{Pointer: node, NodeValue: node.Data}
+}
+
+// findFirst returns the first element below root with the tag, and the class
+// when one is given
+func findFirst(root soup.Root, tag, class string) soup.Root {
+	if htmlParser == "soup" {
+		if class == "" {
+			return root.Find(tag)
+		}
+		return root.Find(tag, "class", class)
+	}
+
+	if nodes := matchNodes(root.Pointer, tag, class, true); len(nodes) > 0 {
+		return soup.Root{Pointer: nodes[0], NodeValue: nodes[0].Data}
+	}
+	// worded like soup's error, which ends up in the warnings of lenient parses
+	attrs := ""
+	if class != "" {
+		attrs = "class " + class
+	}
+	return soup.Root{Error: fmt.Errorf("element `%s` with attributes `%s` not found", tag, attrs)}
+}
+
+// findEvery returns every element below root with the tag, and the class when
+// one is given, in document order
+func findEvery(root soup.Root, tag, class string) []soup.Root {
+	if htmlParser == "soup" {
+		if class == "" {
+			return root.FindAll(tag)
+		}
+		return root.FindAll(tag, "class", class)
+	}
+
+	nodes := matchNodes(root.Pointer, tag, class, false)
+	found := make([]soup.Root, 0, len(nodes))
+	for _, node := range nodes {
+		found = append(found, soup.Root{Pointer: node, NodeValue: node.Data})
+	}
+	return found
+}
+
+// matchNodes walks the descendants of node depth first, collecting the elements
+// with the tag whose class list holds class
+func matchNodes(node *html.Node, tag, class string, first bool) []*html.Node {
+	var matched []*html.Node
+
+	var walk func(*html.Node) bool
+	walk = func(n *html.Node) bool {
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type == html.ElementNode && child.Data == tag && hasClass(child, class) {
+				matched = append(matched, child)
+				if first {
+					return true
+				}
+			}
+			if walk(child) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if node != nil {
+		walk(node)
+	}
+	return matched
+}
+
+func hasClass(node *html.Node, class string) bool {
+	if class == "" {
+		return true
+	}
+
+	for _, attr := range node.Attr {
+		if attr.Key != "class" {
+			continue
+		}
+		for _, name := range strings.Fields(attr.Val) {
+			if name == class {
+				return true
+			}
+		}
+	}
+	return false
+}
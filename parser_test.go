@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readTestPages returns the item pages under testdata keyed by file name
+func readTestPages(tb testing.TB) map[string]string {
+	tb.Helper()
+
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.html"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	pages := make(map[string]string, len(paths))
+	for _, path := range paths {
+		page, err := os.ReadFile(path)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		pages[filepath.Base(path)] = string(page)
+	}
+	return pages
+}
+
+func TestParsersAgree(t *testing.T) {
+	defer func(parser string, enabled bool) { htmlParser, lenient = parser, enabled }(htmlParser, lenient)
+
+	parsed := 0
+	for name, page := range readTestPages(t) {
+		for _, lenient = range []bool{false, true} {
+			htmlParser = "soup"
+			soupItem, soupErr := ParseItem(page)
+
+			htmlParser = "html"
+			htmlItem, htmlErr := ParseItem(page)
+
+			if (soupErr == nil) != (htmlErr == nil) || (soupErr != nil && soupErr.Error() != htmlErr.Error()) {
+				t.Errorf("%s, lenient %v: soup failed with %v, html with %v", name, lenient, soupErr, htmlErr)
+			} else if !reflect.DeepEqual(soupItem, htmlItem) {
+				t.Errorf("%s, lenient %v: soup parsed\n%+v\nhtml parsed\n%+v", name, lenient, soupItem, htmlItem)
+			} else if soupItem != nil {
+				parsed++
+			}
+		}
+	}
+
+	if parsed == 0 {
+		t.Fatal("none of the pages under testdata parsed")
+	}
+}
@@ -0,0 +1,69 @@
+// This file contains the prefetch of the items following a requested one, for
+// clients browsing a collection in order
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+var (
+	// prefetchCount is how many of the ids following a requested item are cached
+	// in the background, 0 disables prefetching
+	prefetchCount = GetenvIntOrDefault("RARITYMON_PREFETCH_COUNT", 0)
+
+	prefetchMu  sync.Mutex
+	prefetching = make(map[hotKey]bool)
+)
+
+// claimPrefetch marks an item as being prefetched, false when it already is
+func claimPrefetch(key hotKey) bool {
+	prefetchMu.Lock()
+	defer prefetchMu.Unlock()
+
+	if prefetching[key] {
+		return false
+	}
+	prefetching[key] = true
+	return true
+}
+
+func releasePrefetch(key hotKey) {
+	prefetchMu.Lock()
+	delete(prefetching, key)
+	prefetchMu.Unlock()
+}
+
+// prefetchAfter caches the prefetchCount ids following id in the background,
+// one at a time. Items already cached or being prefetched are skipped, and the
+// prefetch stops at the first failure, which past the end of a collection is
+// the item not being found.
+func prefetchAfter(cache Cache, collection string, id int) {
+	if prefetchCount <= 0 || readOnly {
+		return
+	}
+
+	go func() {
+		for next := id + 1; next <= id+prefetchCount; next++ {
+			if backoffRemaining() > 0 {
+				return
+			}
+
+			key := hotKey{collection, next}
+			if getCached(cache, collection, next) != nil || !claimPrefetch(key) {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+			_, _, err := fetchAndCache(ctx, cache, collection, next)
+			cancel()
+			releasePrefetch(key)
+
+			if err != nil {
+				prefetches.Inc("failed")
+				return
+			}
+			prefetches.Inc("fetched")
+		}
+	}()
+}
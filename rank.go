@@ -0,0 +1,92 @@
+// This file contains the rank only view of items, for consumers that don't need
+// the traits
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// lightRank is the default of ?light=, which answers rank misses by reading only
+// the rank off the page instead of parsing and caching the whole item
+var lightRank = GetenvBoolOrDefault("RARITYMON_LIGHT_RANK", false)
+
+type RankInfo struct {
+	Rank  int `json:"rank"`
+	Total int `json:"total"`
+
+	// Light is set when the rank was read off the page without parsing the item
+	Light bool `json:"light,omitempty"`
+}
+
+// fetchRank reads the rank of an item off its page. Nothing is cached.
+func fetchRank(ctx context.Context, cache Cache, collection string, id int) (RankInfo, error) {
+	if readOnly {
+		return RankInfo{}, ErrorReadOnly
+	} else if isTombstoned(cache, collection, id) {
+		return RankInfo{}, ErrorTombstoned
+	} else if negativeTTL > 0 && hasMarker(cache, negativeBucket, collection, id) {
+		return RankInfo{}, ErrorNotFound
+	}
+
+	release, err := acquireSlots(ctx, collection)
+	if err != nil {
+		return RankInfo{}, err
+	}
+	page, err := FetchPage(ctx, collection, id)
+	release()
+
+	if err != nil {
+		return RankInfo{}, err
+	}
+
+	rank, total, err := ParseRank(page)
+	return RankInfo{Rank: rank, Total: total, Light: true}, err
+}
+
+func rankHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		collection := c.Param("collection")
+		id, err := strconv.Atoi(c.Param("id"))
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		timeout, err := requestUpstreamTimeout(c)
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		encodedJson := getCached(cache, collection, id)
+
+		if encodedJson == nil {
+			ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+			defer cancel()
+
+			if boolOption(c, "light", lightRank) {
+				info, err := fetchRank(ctx, cache, collection, id)
+				if err != nil {
+					return fetchError(c, err, timeout)
+				}
+				return c.JSON(http.StatusOK, info)
+			}
+
+			if encodedJson, _, err = fetchAndCache(ctx, cache, collection, id); err != nil {
+				return fetchError(c, err, timeout)
+			}
+		}
+
+		item := &Item{}
+		if err := json.Unmarshal(encodedJson, item); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, RankInfo{Rank: item.Rank, Total: item.Total})
+	}
+}
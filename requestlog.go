@@ -0,0 +1,69 @@
+// This file contains the request log, sampled so busy instances aren't flooded
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	// requestLog logs a line per request. Errors and cache misses are always
+	// logged, cache hits only 1 in logSampleHits and other successes 1 in logSampleOK.
+	requestLog    = GetenvBoolOrDefault("RARITYMON_REQUEST_LOG", false)
+	logSampleHits = GetenvIntOrDefault("RARITYMON_LOG_SAMPLE_HITS", 1)
+	logSampleOK   = GetenvIntOrDefault("RARITYMON_LOG_SAMPLE_OK", 1)
+
+	hitRequests atomic.Uint64
+	okRequests  atomic.Uint64
+)
+
+// cacheResultKey is the context key the item routes record "hit" or "miss" under
+const cacheResultKey = "cacheResult"
+
+// sampled reports whether this is the request out of every rate counted by seen
+// that gets logged
+func sampled(seen *atomic.Uint64, rate int) bool {
+	if rate <= 1 {
+		return true
+	}
+	return (seen.Add(1)-1)%uint64(rate) == 0
+}
+
+func requestLogger(next echo.HandlerFunc) echo.HandlerFunc {
+	if !requestLog {
+		return next
+	}
+
+	return func(c echo.Context) error {
+		start := time.Now()
+
+		// let echo write the error now so the status it ends up with is logged
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+
+		status := c.Response().Status
+		result, _ := c.Get(cacheResultKey).(string)
+
+		switch {
+		case status >= 400 || result == "miss":
+		case result == "hit":
+			if !sampled(&hitRequests, logSampleHits) {
+				return nil
+			}
+		default:
+			if !sampled(&okRequests, logSampleOK) {
+				return nil
+			}
+		}
+
+		if result != "" {
+			result = " cache " + result
+		}
+		log.Printf("%s %s %d %s%s\n", c.Request().Method, c.Request().RequestURI, status, time.Since(start), result)
+		return nil
+	}
+}
@@ -0,0 +1,568 @@
+// This file contains the shaping of item responses according to the request options
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	// dropNone is the default of ?dropNone=, which leaves out the traits whose
+	// value is one of noneValues
+	dropNone   = GetenvBoolOrDefault("RARITYMON_DROP_NONE", false)
+	noneValues = strings.Split(GetenvOrDefault("RARITYMON_NONE_VALUES", "None"), ",")
+
+	// basisPoints is the default of ?basisPoints=, which adds each trait's
+	// percentage as whole basis points
+	basisPoints = GetenvBoolOrDefault("RARITYMON_BASIS_POINTS", false)
+)
+
+// boolOption reads a boolean query parameter, falling back to def when unset
+func boolOption(c echo.Context, name string, def bool) bool {
+	if val := c.QueryParam(name); val != "" {
+		parsed, _ := strconv.ParseBool(val)
+		return parsed
+	}
+	return def
+}
+
+// responseMeta describes how a response was produced, it's only included when
+// the request asks for ?timing=true
+type responseMeta struct {
+	CacheHit bool    `json:"cacheHit" xml:"cacheHit"`
+	FetchMs  float64 `json:"fetchMs" xml:"fetchMs"`
+	ParseMs  float64 `json:"parseMs" xml:"parseMs"`
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// itemResponse is an item decorated with the additions requested through the
+// query string
+type itemResponse struct {
+	XMLName xml.Name `json:"-" xml:"item"`
+	*Item
+	TraitGroups TraitGroups     `json:"traitGroups,omitempty" xml:"traitGroups,omitempty"`
+	Collection  *CollectionInfo `json:"collection,omitempty" xml:"collection,omitempty"`
+	Contract    *ContractInfo   `json:"contract,omitempty" xml:"contract,omitempty"`
+	TraitPage   *TraitPage      `json:"traitPage,omitempty" xml:"traitPage,omitempty"`
+	// TraitList replaces Traits when the request asks for them sorted, with the
+	// RarestTrait alongside
+	TraitList   TraitList `json:"traitList,omitempty" xml:"traitList,omitempty"`
+	RarestTrait *Trait    `json:"rarestTrait,omitempty" xml:"rarestTrait,omitempty"`
+	// ComputedRank is the position of the item's score among the cached items of
+	// its collection, for items RarityMon doesn't rank yet
+	ComputedRank int `json:"computedRank,omitempty" xml:"computedRank,omitempty"`
+	// OrdinalRank is the rank for display, such as "23rd / 1000"
+	OrdinalRank string `json:"ordinalRank,omitempty" xml:"ordinalRank,omitempty"`
+	// FetchedAt is when the item was scraped, or last found unchanged, in RFC3339
+	FetchedAt string        `json:"fetchedAt,omitempty" xml:"fetchedAt,omitempty"`
+	Meta      *responseMeta `json:"_meta,omitempty" xml:"meta,omitempty"`
+}
+
+// TraitList holds traits in the order they're listed
+type TraitList []Trait
+
+// MarshalXML writes the traits as a list of trait elements. A traitList>trait
+// tag would write an empty traitList for unsorted items despite omitempty.
+func (l TraitList) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+
+	for _, trait := range l {
+		if err := e.EncodeElement(trait, xml.StartElement{Name: xml.Name{Local: "trait"}}); err != nil {
+			return err
+		}
+	}
+
+	return e.EncodeToken(start.End())
+}
+
+// TraitGroups holds traits nested under a tier or percentage band
+type TraitGroups map[string]TraitMap
+
+// MarshalXML writes each group as a group element named by an attribute
+func (g TraitGroups) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	names := make([]string, 0, len(g))
+	for name := range g {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		group := xml.StartElement{
+			Name: xml.Name{Local: "group"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: name}},
+		}
+		if err := e.EncodeElement(g[name], group); err != nil {
+			return err
+		}
+	}
+
+	return e.EncodeToken(start.End())
+}
+
+// TraitPage describes the slice of an item's traits, ordered by type, returned
+// for ?traitOffset= and ?traitLimit=
+type TraitPage struct {
+	Offset int `json:"offset" xml:"offset"`
+	Limit  int `json:"limit" xml:"limit"`
+	Total  int `json:"total" xml:"total"`
+}
+
+// parseTraitPage reads ?traitOffset= and ?traitLimit=, returning nil when neither
+// is set. A limit of 0 means every trait from the offset on.
+func parseTraitPage(c echo.Context) (*TraitPage, error) {
+	offset, limit := c.QueryParam("traitOffset"), c.QueryParam("traitLimit")
+	if offset == "" && limit == "" {
+		return nil, nil
+	}
+
+	page := &TraitPage{}
+	for _, param := range []struct {
+		name  string
+		value string
+		dest  *int
+	}{{"traitOffset", offset, &page.Offset}, {"traitLimit", limit, &page.Limit}} {
+		if param.value == "" {
+			continue
+		}
+
+		num, err := strconv.Atoi(param.value)
+		if err != nil || num < 0 {
+			return nil, fmt.Errorf("%s must be a non-negative number", param.name)
+		}
+		*param.dest = num
+	}
+
+	return page, nil
+}
+
+// sortTraits lists the traits by type, or rarest first by percentage with ties
+// broken by type
+func sortTraits(traits TraitMap, by string) []Trait {
+	list := make([]Trait, 0, len(traits))
+	for _, trait := range traits {
+		list = append(list, trait)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if by == "percentage" && list[i].Percentage != list[j].Percentage {
+			return list[i].Percentage < list[j].Percentage
+		}
+		return list[i].Type < list[j].Type
+	})
+	return list
+}
+
+// pageTraitList returns the listed traits on the page and fills in the total
+func pageTraitList(list []Trait, page *TraitPage) []Trait {
+	page.Total = len(list)
+
+	start := page.Offset
+	if start > len(list) {
+		start = len(list)
+	}
+	end := len(list)
+	if page.Limit > 0 && start+page.Limit < end {
+		end = start + page.Limit
+	}
+
+	return list[start:end]
+}
+
+// pageTraits returns the traits on the page, ordered by type, and fills in the total
+func pageTraits(traits TraitMap, page *TraitPage) TraitMap {
+	list := pageTraitList(sortTraits(traits, "type"), page)
+
+	paged := make(TraitMap, len(list))
+	for _, trait := range list {
+		paged[trait.Type] = trait
+	}
+	return paged
+}
+
+// toBasisPoints converts a percentage to basis points, rounded half away from
+// zero. The rounding is done on the shortest decimal form of the percentage,
+// which is how it was scraped, as the float itself often sits a hair under the
+// half, 0.145 being stored as 0.14499999999999999.
+func toBasisPoints(percentage float64) int {
+	exact, ok := new(big.Rat).SetString(strconv.FormatFloat(percentage, 'f', -1, 64))
+	if !ok {
+		return int(math.Round(percentage * 100))
+	}
+	exact.Mul(exact, big.NewRat(100, 1))
+
+	points, rem := new(big.Int).QuoRem(exact.Num(), exact.Denom(), new(big.Int))
+	if rem.Abs(rem).Lsh(rem, 1).Cmp(exact.Denom()) >= 0 {
+		points.Add(points, big.NewInt(int64(exact.Sign())))
+	}
+	return int(points.Int64())
+}
+
+// withBasisPoints returns the traits with BasisPoints set from their percentage
+func withBasisPoints(traits TraitMap) TraitMap {
+	converted := make(TraitMap, len(traits))
+
+	for key, trait := range traits {
+		points := toBasisPoints(trait.Percentage)
+		trait.BasisPoints = &points
+		converted[key] = trait
+	}
+
+	return converted
+}
+
+// dropNoneTraits returns the traits without the ones valued one of noneValues
+func dropNoneTraits(traits TraitMap) TraitMap {
+	kept := make(TraitMap, len(traits))
+
+traits:
+	for key, trait := range traits {
+		for _, none := range noneValues {
+			if strings.EqualFold(strings.TrimSpace(trait.Name), strings.TrimSpace(none)) {
+				continue traits
+			}
+		}
+		kept[key] = trait
+	}
+
+	return kept
+}
+
+// percentageBands are the upper bounds (exclusive) of the ?group=percentage bands,
+// traits at or above the last bound fall into the final open band
+var percentageBands = []struct {
+	upper float64
+	label string
+}{
+	{1, "<1%"},
+	{5, "1-5%"},
+	{10, "5-10%"},
+	{25, "10-25%"},
+	{50, "25-50%"},
+}
+
+func percentageBand(percentage float64) string {
+	for _, band := range percentageBands {
+		if percentage < band.upper {
+			return band.label
+		}
+	}
+	return ">=50%"
+}
+
+// groupTraits nests the traits under their tier or percentage band
+func groupTraits(traits TraitMap, by string) TraitGroups {
+	groups := make(TraitGroups)
+
+	for key, trait := range traits {
+		group := trait.Tier
+		if by == "percentage" {
+			group = percentageBand(trait.Percentage)
+		}
+
+		if groups[group] == nil {
+			groups[group] = make(TraitMap)
+		}
+		groups[group][key] = trait
+	}
+
+	return groups
+}
+
+// requirableFields are the fields ?require= accepts, each with whether an item
+// is missing it
+var requirableFields = map[string]func(*Item) bool{
+	"rank":   func(item *Item) bool { return item.Rank <= 0 },
+	"score":  func(item *Item) bool { return item.Score < 0 },
+	"traits": func(item *Item) bool { return len(item.Traits) == 0 },
+	"name":   func(item *Item) bool { return item.Name == "" },
+}
+
+// parseRequire reads the fields of ?require=, nil when the request has none
+func parseRequire(c echo.Context) ([]string, error) {
+	val := c.QueryParam("require")
+	if val == "" {
+		return nil, nil
+	}
+
+	fields := strings.Split(val, ",")
+	for i, field := range fields {
+		fields[i] = strings.TrimSpace(field)
+		if _, ok := requirableFields[fields[i]]; !ok {
+			return nil, fmt.Errorf("require can only list rank, score, traits and name, not %q", fields[i])
+		}
+	}
+	return fields, nil
+}
+
+// incompleteItemError lists the required fields the item is missing, nil when
+// it has all of them
+func incompleteItemError(item *Item, required []string) error {
+	var missing []string
+	for _, field := range required {
+		if requirableFields[field](item) {
+			missing = append(missing, field)
+		}
+	}
+	if missing == nil {
+		return nil
+	}
+
+	return echo.NewHTTPError(http.StatusUnprocessableEntity, errorBody{
+		Message: "the item is missing " + strings.Join(missing, ", "),
+		Code:    "incomplete_item",
+		Missing: missing,
+	})
+}
+
+// plainItemRequest reports whether a request asks for the item as it's cached,
+// without any additions and for a collection without a configured contract
+func plainItemRequest(c echo.Context) bool {
+	timing, _ := strconv.ParseBool(c.QueryParam("timing"))
+	enrich, _ := strconv.ParseBool(c.QueryParam("enrich"))
+
+	dropNone := boolOption(c, "dropNone", dropNone)
+	basisPoints := boolOption(c, "basisPoints", basisPoints)
+	computeRank, _ := strconv.ParseBool(c.QueryParam("computeRank"))
+	ordinal, _ := strconv.ParseBool(c.QueryParam("ordinal"))
+
+	asXML := c.QueryParam("format") == "xml" ||
+		strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMEApplicationXML)
+
+	_, hasContract := contracts[c.Param("collection")]
+
+	return !timing && !enrich && !dropNone && !basisPoints && !computeRank && !ordinal && c.QueryParam("group") == "" && c.QueryParam("require") == "" &&
+		c.QueryParam("traitOffset") == "" && c.QueryParam("traitLimit") == "" && c.QueryParam("traitSort") == "" &&
+		!asXML && !wantsMsgpack(c) && !hasContract && jsonCase == "camel" && !responseEnvelope && hiddenFields(c) == nil
+}
+
+// hideItemFields zeroes the fields of item named in hidden by their JSON name
+func hideItemFields(item *Item, hidden map[string]bool) {
+	v := reflect.ValueOf(item).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		if hidden[name] {
+			v.Field(i).Set(reflect.Zero(v.Field(i).Type()))
+		}
+	}
+}
+
+// ordinalRank formats a rank as "1st / 1000", leaving out the total when it's
+// unknown, and returns "" when the rank is
+func ordinalRank(rank, total int) string {
+	if rank <= 0 {
+		return ""
+	}
+
+	suffix := "th"
+	switch rank % 100 {
+	case 11, 12, 13:
+	default:
+		switch rank % 10 {
+		case 1:
+			suffix = "st"
+		case 2:
+			suffix = "nd"
+		case 3:
+			suffix = "rd"
+		}
+	}
+
+	if total <= 0 {
+		return strconv.Itoa(rank) + suffix
+	}
+	return fmt.Sprintf("%d%s / %d", rank, suffix, total)
+}
+
+// fetchedAtKey is the context key the fetch time of the item being served is
+// passed to respondItem under
+const fetchedAtKey = "fetchedAt"
+
+// describeEntry lists the parse warnings of the cache entry of the item being
+// served in the X-Raritymon-Warnings header, and its fetch time in the
+// X-Raritymon-Fetched-At header and hands it to respondItem. Compressed items
+// passed through as is only carry the header.
+func describeEntry(c echo.Context, entry cacheEntry) {
+	if len(entry.ParseWarnings) > 0 {
+		c.Response().Header().Set("X-Raritymon-Warnings", strings.Join(entry.ParseWarnings, "; "))
+	}
+	if entry.FetchedAt != nil {
+		fetchedAt := entry.FetchedAt.UTC().Format(time.RFC3339)
+		c.Response().Header().Set("X-Raritymon-Fetched-At", fetchedAt)
+		c.Set(fetchedAtKey, fetchedAt)
+	}
+}
+
+// withFetchedAt adds a fetchedAt field to item JSON as it's cached
+func withFetchedAt(itemJson []byte, fetchedAt string) []byte {
+	start := bytes.IndexByte(itemJson, '{')
+	if start < 0 {
+		return itemJson
+	}
+
+	field, _ := json.Marshal(fetchedAt)
+	spliced := make([]byte, 0, len(itemJson)+len(field)+14)
+	spliced = append(spliced, itemJson[:start+1]...)
+	spliced = append(spliced, `"fetchedAt":`...)
+	spliced = append(spliced, field...)
+	spliced = append(spliced, ',')
+	return append(spliced, itemJson[start+1:]...)
+}
+
+// respondItem writes the encoded item. The cached bytes are passed through as is
+// unless the request asks for additions or the collection has a configured contract.
+func respondItem(c echo.Context, cache Cache, itemJson []byte, meta responseMeta) error {
+	timing, _ := strconv.ParseBool(c.QueryParam("timing"))
+	enrich, _ := strconv.ParseBool(c.QueryParam("enrich"))
+	group := c.QueryParam("group")
+
+	dropNone := boolOption(c, "dropNone", dropNone)
+	basisPoints := boolOption(c, "basisPoints", basisPoints)
+	computeRank, _ := strconv.ParseBool(c.QueryParam("computeRank"))
+	ordinal, _ := strconv.ParseBool(c.QueryParam("ordinal"))
+	traitSort := c.QueryParam("traitSort")
+
+	if group != "" && group != "tier" && group != "percentage" {
+		return echo.NewHTTPError(http.StatusBadRequest, "group must be either tier or percentage")
+	}
+
+	if traitSort != "" && traitSort != "percentage" && traitSort != "type" {
+		return echo.NewHTTPError(http.StatusBadRequest, "traitSort must be either percentage or type")
+	} else if traitSort != "" && group != "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "traitSort can't be combined with group")
+	}
+
+	traitPage, err := parseTraitPage(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	required, err := parseRequire(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	asXML := c.QueryParam("format") == "xml" ||
+		strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMEApplicationXML)
+
+	contract, hasContract := contracts[c.Param("collection")]
+
+	fetchedAt, _ := c.Get(fetchedAtKey).(string)
+
+	if plainItemRequest(c) {
+		if fetchedAt != "" {
+			itemJson = withFetchedAt(itemJson, fetchedAt)
+		}
+		return c.JSONBlob(http.StatusOK, itemJson)
+	}
+
+	response := itemResponse{Item: &Item{}, FetchedAt: fetchedAt}
+	if err := json.Unmarshal(itemJson, response.Item); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := incompleteItemError(response.Item, required); err != nil {
+		return err
+	}
+
+	if timing {
+		response.Meta = &meta
+	}
+
+	if hasContract {
+		response.Contract = &contract
+	}
+
+	if dropNone {
+		response.Traits = dropNoneTraits(response.Traits)
+	}
+
+	if computeRank && response.Rank <= 0 && response.Score >= 0 {
+		items, err := cachedItems(cache, c.Param("collection"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		id, _ := strconv.Atoi(c.Param("id"))
+		response.ComputedRank = computedRank(response.Item, id, items)
+	}
+
+	if basisPoints {
+		response.Traits = withBasisPoints(response.Traits)
+	}
+
+	if traitSort != "" {
+		rarest := sortTraits(response.Traits, "percentage")
+		if len(rarest) > 0 {
+			response.RarestTrait = &rarest[0]
+		}
+
+		response.TraitList = rarest
+		if traitSort == "type" {
+			response.TraitList = sortTraits(response.Traits, "type")
+		}
+		response.Traits = nil
+	}
+
+	if traitPage != nil && traitSort != "" {
+		response.TraitList = pageTraitList(response.TraitList, traitPage)
+		response.TraitPage = traitPage
+	} else if traitPage != nil {
+		response.Traits = pageTraits(response.Traits, traitPage)
+		response.TraitPage = traitPage
+	}
+
+	if group != "" {
+		response.TraitGroups = groupTraits(response.Traits, group)
+		response.Traits = nil
+	}
+
+	// HEAD requests are answered from the cache alone, while the collection info
+	// might have to be fetched
+	if enrich && c.Request().Method != http.MethodHead {
+		info, err := getCollectionInfo(cache, c.Param("collection"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadGateway, err.Error())
+		}
+
+		// Total stays the ranked total, the collection's supply only fills in
+		// Supply when the item page didn't show it
+		response.Collection = info
+		if response.Supply == 0 {
+			response.Supply = info.Supply
+		}
+	}
+
+	if ordinal {
+		response.OrdinalRank = ordinalRank(response.Rank, response.Total)
+	}
+
+	if asXML {
+		// the JSON encoders leave hidden fields out, XML ones are only zeroed
+		hideItemFields(response.Item, hiddenFields(c))
+		return c.XML(http.StatusOK, response)
+	} else if wantsMsgpack(c) {
+		return respondMsgpack(c, response)
+	}
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestToBasisPoints(t *testing.T) {
+	tests := []struct {
+		percentage float64
+		want       int
+	}{
+		{0, 0},
+		{100, 10000},
+		{12.34, 1234},
+		{0.145, 15},
+		{0.285, 29},
+		{1.005, 101},
+		{12.345, 1235},
+		{0.125, 13},
+		{0.005, 1},
+		{0.0049, 0},
+		{0.01, 1},
+		{33.333333333333336, 3333},
+		{66.66666666666667, 6667},
+		{-0.145, -15},
+	}
+
+	for _, test := range tests {
+		if got := toBasisPoints(test.percentage); got != test.want {
+			t.Errorf("toBasisPoints(%v) = %d, want %d", test.percentage, got, test.want)
+		}
+	}
+}
+
+func TestWithBasisPoints(t *testing.T) {
+	traits := TraitMap{
+		"Hat":  {Type: "Hat", Name: "Cap", Percentage: 1.005},
+		"Eyes": {Type: "Eyes", Name: "Laser", Percentage: 0.5},
+	}
+
+	converted := withBasisPoints(traits)
+
+	if converted["Hat"].BasisPoints == nil || *converted["Hat"].BasisPoints != 101 {
+		t.Errorf("Hat basis points = %v, want 101", converted["Hat"].BasisPoints)
+	}
+	if converted["Eyes"].BasisPoints == nil || *converted["Eyes"].BasisPoints != 50 {
+		t.Errorf("Eyes basis points = %v, want 50", converted["Eyes"].BasisPoints)
+	}
+	if traits["Hat"].BasisPoints != nil {
+		t.Error("withBasisPoints modified the traits it was given")
+	}
+}
+
+func TestItemXML(t *testing.T) {
+	item := &Item{
+		TokenID: 7,
+		Name:    "Test & #7",
+		Rank:    3,
+		Total:   10,
+		Score:   12.5,
+		Traits: TraitMap{
+			"Hat":  {Type: "Hat", Name: "Cap", Tier: "Rare", Percentage: 1.5},
+			"Eyes": {Type: "Eyes", Name: "Blue", Tier: "Common", Percentage: 25},
+		},
+		Warnings:      []string{"score: missing"},
+		ParseWarnings: []string{"trait \"Mouth\" not recognized"},
+	}
+
+	tests := []struct {
+		name     string
+		response itemResponse
+		want     string
+	}{
+		{
+			"plain",
+			itemResponse{Item: item},
+			`<item><tokenId>7</tokenId><name>Test &amp; #7</name><rank>3</rank><total>10</total><score>12.5</score>` +
+				`<traits><trait><type>Eyes</type><name>Blue</name><tier>Common</tier><percentage>25</percentage></trait>` +
+				`<trait><type>Hat</type><name>Cap</name><tier>Rare</tier><percentage>1.5</percentage></trait></traits>` +
+				`<warning>score: missing</warning></item>`,
+		},
+		{
+			"sorted",
+			itemResponse{Item: &Item{Name: "Test #8", Rank: -1, Total: -1, Score: -1}, TraitList: TraitList{item.Traits["Hat"], item.Traits["Eyes"]}},
+			`<item><name>Test #8</name><rank>-1</rank><total>-1</total><score>-1</score>` +
+				`<traitList><trait><type>Hat</type><name>Cap</name><tier>Rare</tier><percentage>1.5</percentage></trait>` +
+				`<trait><type>Eyes</type><name>Blue</name><tier>Common</tier><percentage>25</percentage></trait></traitList></item>`,
+		},
+		{
+			"timed",
+			itemResponse{Item: &Item{Name: "Test #8", Rank: -1, Total: -1, Score: -1}, Meta: &responseMeta{CacheHit: true}},
+			`<item><name>Test #8</name><rank>-1</rank><total>-1</total><score>-1</score>` +
+				`<meta><cacheHit>true</cacheHit><fetchMs>0</fetchMs><parseMs>0</parseMs></meta></item>`,
+		},
+	}
+
+	for _, test := range tests {
+		encoded, err := xml.Marshal(test.response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(encoded) != test.want {
+			t.Errorf("%s item encoded to\n%s\nwant\n%s", test.name, encoded, test.want)
+		}
+	}
+}
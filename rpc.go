@@ -0,0 +1,188 @@
+// This file contains the JSON-RPC 2.0 endpoint, for clients that don't speak REST
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// rpcConcurrency is how many calls of a batch are served at once
+var rpcConcurrency = GetenvIntOrDefault("RARITYMON_RPC_CONCURRENCY", 4)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// the JSON-RPC defined error codes, and the server errors of this service
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcNotFound       = -32001
+	rpcUnavailable    = -32002
+	rpcTimeout        = -32003
+)
+
+type getItemParams struct {
+	Collection string `json:"collection"`
+	ID         int    `json:"id"`
+}
+
+// rpcFetchError maps the error of fetching an item to a JSON-RPC error
+func rpcFetchError(err error) *rpcError {
+	switch {
+	case err == ErrorCollectionNotFound || err == ErrorReadOnly || err == ErrorTombstoned || err == ErrorItemNotFound || err == ErrorNotFound || errors.Is(err, ErrorNodeNotFound):
+		return &rpcError{rpcNotFound, err.Error()}
+	case err == ErrorUpstreamBackoff || err == ErrorFetchQueueFull || errors.Is(err, ErrorUpstreamBudget):
+		return &rpcError{rpcUnavailable, err.Error()}
+	case err == context.DeadlineExceeded:
+		return &rpcError{rpcTimeout, "RarityMon didn't respond within " + upstreamTimeout.String()}
+	}
+	return &rpcError{rpcInternalError, err.Error()}
+}
+
+// callGetItem returns the item asked for, without the fields in hidden
+func callGetItem(ctx context.Context, cache Cache, params json.RawMessage, hidden map[string]bool) (interface{}, *rpcError) {
+	p := getItemParams{}
+	if err := json.Unmarshal(params, &p); err != nil || p.Collection == "" {
+		return nil, &rpcError{rpcInvalidParams, "params must be an object with a collection and an id"}
+	}
+	p.Collection = normalizeCollection(p.Collection)
+
+	encodedJson := getCached(cache, p.Collection, p.ID)
+	if encodedJson == nil {
+		ctx, cancel := context.WithTimeout(withUpstreamBudget(ctx), upstreamTimeout)
+		defer cancel()
+
+		var err error
+		if encodedJson, _, err = fetchAndCache(ctx, cache, p.Collection, p.ID); err != nil {
+			return nil, rpcFetchError(err)
+		}
+	}
+
+	if hidden == nil {
+		return json.RawMessage(encodedJson), nil
+	}
+
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(encodedJson, &fields); err != nil {
+		return nil, &rpcError{rpcInternalError, err.Error()}
+	}
+	for name := range hidden {
+		delete(fields, name)
+	}
+	return fields, nil
+}
+
+// serveRPC answers a single call, returning nil for notifications
+func serveRPC(ctx context.Context, cache Cache, raw json.RawMessage, hidden map[string]bool) *rpcResponse {
+	req := rpcRequest{}
+	if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+		return &rpcResponse{JSONRPC: "2.0", Error: &rpcError{rpcInvalidRequest, "invalid request"}, ID: json.RawMessage("null")}
+	}
+
+	response := &rpcResponse{JSONRPC: "2.0", ID: req.ID}
+	switch req.Method {
+	case "getItem":
+		response.Result, response.Error = callGetItem(ctx, cache, req.Params, hidden)
+	default:
+		response.Error = &rpcError{rpcMethodNotFound, "method not found"}
+	}
+
+	if req.ID == nil {
+		return nil
+	}
+	return response
+}
+
+// respondRPC writes a JSON-RPC response as is, bypassing the envelope and the
+// JSON case the serializer applies to the rest of the API
+func respondRPC(c echo.Context, response interface{}) error {
+	body, err := json.Marshal(response)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSONBlob(http.StatusOK, body)
+}
+
+// rpcHandler serves single JSON-RPC 2.0 calls and batches of them, running up to
+// rpcConcurrency calls of a batch at once
+func rpcHandler(cache Cache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		ctx := c.Request().Context()
+		hidden := hiddenFields(c)
+		body = bytes.TrimSpace(body)
+
+		if !bytes.HasPrefix(body, []byte("[")) {
+			if !json.Valid(body) {
+				return respondRPC(c, rpcResponse{JSONRPC: "2.0", Error: &rpcError{rpcParseError, "parse error"}, ID: json.RawMessage("null")})
+			}
+			if response := serveRPC(ctx, cache, body, hidden); response != nil {
+				return respondRPC(c, response)
+			}
+			return c.NoContent(http.StatusNoContent)
+		}
+
+		batch := []json.RawMessage{}
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return respondRPC(c, rpcResponse{JSONRPC: "2.0", Error: &rpcError{rpcParseError, "parse error"}, ID: json.RawMessage("null")})
+		} else if len(batch) == 0 {
+			return respondRPC(c, rpcResponse{JSONRPC: "2.0", Error: &rpcError{rpcInvalidRequest, "empty batch"}, ID: json.RawMessage("null")})
+		}
+
+		responses := make([]*rpcResponse, len(batch))
+		slots := make(chan struct{}, rpcConcurrency)
+		wg := sync.WaitGroup{}
+
+		for i, raw := range batch {
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(i int, raw json.RawMessage) {
+				defer func() { <-slots; wg.Done() }()
+				responses[i] = serveRPC(ctx, cache, raw, hidden)
+			}(i, raw)
+		}
+		wg.Wait()
+
+		answered := []*rpcResponse{}
+		for _, response := range responses {
+			if response != nil {
+				answered = append(answered, response)
+			}
+		}
+
+		if len(answered) == 0 {
+			return c.NoContent(http.StatusNoContent)
+		}
+		return respondRPC(c, answered)
+	}
+}
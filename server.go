@@ -0,0 +1,232 @@
+// This file contains the HTTP server exposing the scraped RarityMon data
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+var (
+	// pathPrefix mounts every route under a path, for running behind a proxy
+	pathPrefix = cleanPathPrefix(GetenvOrDefault("RARITYMON_PATH_PREFIX", ""))
+
+	// unprefixedOps keeps /health, /metrics and /version at the root regardless
+	// of pathPrefix, where probes and scrapers usually expect them
+	unprefixedOps = GetenvBoolOrDefault("RARITYMON_UNPREFIXED_OPS", false)
+
+	// lowercaseCollections lowercases the collection in /api paths before it is
+	// cached or sent upstream. Off by default since some slugs are case
+	// sensitive and have to reach RarityMon exactly as sent.
+	lowercaseCollections = GetenvBoolOrDefault("RARITYMON_LOWERCASE_COLLECTIONS", false)
+
+	// bodyLimit caps request bodies, apart from cache imports which are held to
+	// importBodyLimit since a dump of a whole cache easily runs past it
+	bodyLimit       = GetenvOrDefault("RARITYMON_BODY_LIMIT", "4M")
+	importBodyLimit = GetenvOrDefault("RARITYMON_IMPORT_BODY_LIMIT", "1G")
+)
+
+// cleanPathPrefix turns "raritymon/" and the like into "/raritymon"
+func cleanPathPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// normalizeCollection applies lowercaseCollections to a collection slug
+func normalizeCollection(collection string) string {
+	if lowercaseCollections {
+		return strings.ToLower(collection)
+	}
+	return collection
+}
+
+// normalizeAPIPath matches the /api segment regardless of case, so /API/x/1
+// routes like /api/x/1, and normalizes the collection following it
+func normalizeAPIPath(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		path := req.URL.Path
+		if strings.HasPrefix(path, pathPrefix+"/") {
+			segments := strings.SplitN(strings.TrimPrefix(path, pathPrefix+"/"), "/", 3)
+			if strings.EqualFold(segments[0], "api") {
+				segments[0] = "api"
+				if len(segments) > 1 {
+					segments[1] = normalizeCollection(segments[1])
+				}
+				req.URL.Path = pathPrefix + "/" + strings.Join(segments, "/")
+				req.URL.RawPath = ""
+			}
+		}
+		return next(c)
+	}
+}
+
+// reportPanic logs a panic recovered from a handler along with its stack and
+// answers with the usual error shape instead of echo's bare 500
+func reportPanic(c echo.Context, err error, stack []byte) error {
+	handlerPanics.Inc(c.Path())
+	log.Printf("panic serving %s %s: %v\n%s", c.Request().Method, c.Request().URL.Path, err, stack)
+	return echo.NewHTTPError(http.StatusInternalServerError, errorBody{Message: http.StatusText(http.StatusInternalServerError), Code: "panic"})
+}
+
+// handleError renders every error as an errorBody along with the path that was
+// requested, the routing errors of unknown paths and methods included
+func handleError(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	he, ok := err.(*echo.HTTPError)
+	if !ok {
+		log.Printf("error serving %s %s: %v\n", c.Request().Method, c.Request().URL.Path, err)
+		he = echo.NewHTTPError(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+	}
+
+	body := errorBody{}
+	switch message := he.Message.(type) {
+	case errorBody:
+		body = message
+	case string:
+		body.Message = message
+	default:
+		body.Message = fmt.Sprint(message)
+	}
+
+	switch he {
+	case echo.ErrNotFound:
+		body.Code = "route_not_found"
+	case echo.ErrMethodNotAllowed:
+		body.Code = "method_not_allowed"
+	}
+	body.Path = c.Request().URL.Path
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(he.Code)
+	} else {
+		err = c.JSON(he.Code, body)
+	}
+	if err != nil {
+		log.Printf("error response to %s %s: %v\n", c.Request().Method, c.Request().URL.Path, err)
+	}
+}
+
+func main() {
+	switch refreshPolicy {
+	case "bypass", "revalidate", "ignore":
+	default:
+		log.Fatalf("unknown refresh policy %q\n", refreshPolicy)
+	}
+
+	if truncatedPages != "warn" && truncatedPages != "reject" {
+		log.Fatalf("unknown truncated page handling %q\n", truncatedPages)
+	}
+
+	if htmlParser != "soup" && htmlParser != "html" {
+		log.Fatalf("unknown parser %q\n", htmlParser)
+	}
+
+	if jsonCase != "camel" && jsonCase != "snake" {
+		log.Fatalf("unknown JSON case %q\n", jsonCase)
+	}
+
+	if err := loadContracts(); err != nil {
+		log.Fatalln(err)
+	}
+
+	if err := loadCacheTTLs(); err != nil {
+		log.Fatalln(err)
+	}
+
+	cache, err := openCache()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer cache.Close()
+
+	if !readOnly {
+		if err := migrateCacheKeys(cache); err != nil {
+			log.Fatalln(err)
+		}
+		if err := pruneBlobs(cache); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if err := loadStats(cache); err != nil {
+		log.Fatalln(err)
+	}
+
+	registerStorageMetrics(cache)
+
+	go runHotRefresher(cache)
+	go runCompactor(cache)
+	go runBackups(cache)
+	go runStatsFlusher(cache)
+	go runIntegrityCheck(cache)
+	go runSeedCrawls(cache)
+	go watchMaintenanceSignal()
+	go watchReloadSignal()
+
+	e := echo.New()
+	e.JSONSerializer = responseSerializer{}
+	e.HTTPErrorHandler = handleError
+
+	e.Pre(middleware.RemoveTrailingSlash())
+	e.Pre(normalizeAPIPath)
+
+	// inside the request log so it records the 500, ahead of everything else
+	// so their panics are recovered too
+	e.Use(requestLogger)
+	e.Use(middleware.RecoverWithConfig(middleware.RecoverConfig{DisableStackAll: true, LogErrorFunc: reportPanic}))
+	e.Use(middleware.CORS())
+	e.Use(middleware.BodyLimitWithConfig(middleware.BodyLimitConfig{
+		Skipper: func(c echo.Context) bool {
+			return c.Path() == pathPrefix+"/admin/cache/import"
+		},
+		Limit: bodyLimit,
+	}))
+	e.Use(maintenanceMiddleware)
+
+	root := e.Group(pathPrefix)
+	ops := root
+	if unprefixedOps {
+		ops = e.Group("")
+	}
+
+	root.GET("/openapi.json", openAPIHandler(e))
+	ops.GET("/metrics", metricsHandler)
+	ops.GET("/health", healthHandler(cache))
+	ops.GET("/version", versionHandler)
+	root.GET("/stats", statsHandler)
+	root.POST("/rpc", rpcHandler(cache), readAuth())
+	registerAdminRoutes(root, cache)
+
+	// readAuth is applied route by route, a group middleware would make the
+	// group answer unknown methods with 404 instead of 405
+	read := readAuth()
+	api := root.Group("/api")
+	api.GET("/:collection", listCollectionHandler(cache), read, crawlCompleteness)
+	api.GET("/:collection/crawl", crawlStatusHandler, read)
+	api.GET("/:collection/scan", scanHandler(cache), read)
+	api.GET("/:collection/thresholds", thresholdsHandler(cache), read, crawlCompleteness)
+	api.GET("/:collection/distribution", distributionHandler(cache), read, crawlCompleteness)
+	api.POST("/:collection/crawl", startCrawlHandler(cache), read, crawlAuth())
+	api.GET("/:collection/:id/similar", similarHandler(cache), read)
+	api.GET("/:collection/:id/history", historyHandler(cache), read)
+	api.GET("/:collection/token/:id", tokenHandler(cache), read, upstreamBudget)
+	api.GET("/:collection/:id/rank", rankHandler(cache), read, upstreamBudget)
+	api.GET("/:collection/:id", itemHandler(cache), read, upstreamBudget, cacheMiddleware(cache))
+	// takes precedence over a collection literally named "item"
+	api.GET("/item/:id", itemHandler(cache), read, upstreamBudget, withDefaultCollection, cacheMiddleware(cache))
+	api.HEAD("/:collection/token/:id", headItemHandler(cache), read, tokenParam)
+	api.HEAD("/:collection/:id", headItemHandler(cache), read)
+	api.HEAD("/item/:id", headItemHandler(cache), read, withDefaultCollection)
+	e.Start(GetenvOrDefault("RARITYMON_WEB_HOST", ":1337"))
+}
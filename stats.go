@@ -0,0 +1,125 @@
+// This file contains the stats endpoint summarising the service's counters as
+// JSON, and the persistence of their lifetime totals
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	statsBucket = []byte("Stats")
+
+	// statsFlushInterval is how often the counters' lifetime totals are written
+	// to the database, so they survive restarts. Counts since the last flush are
+	// lost when the process stops. 0 disables persisting them.
+	statsFlushInterval = GetenvDurationOrDefault("RARITYMON_STATS_FLUSH_INTERVAL", time.Minute)
+)
+
+type Stats struct {
+	StatCounters
+
+	// Lifetime holds the same counters with the totals of previous runs added,
+	// left out when they aren't persisted
+	Lifetime *StatCounters `json:"lifetime,omitempty"`
+}
+
+type StatCounters struct {
+	// Failures counts failed fetches by reason, the same counts /metrics exposes
+	Failures map[string]uint64 `json:"failures"`
+
+	// ManualOverrides counts the items stored through the admin API
+	ManualOverrides uint64 `json:"manualOverrides"`
+
+	// Fetches counts item fetches by collection and whether they went upstream
+	// (leader) or shared a fetch already in flight (coalesced), keyed "collection,role"
+	Fetches map[string]uint64 `json:"fetches"`
+
+	// CacheResults counts item requests by whether they were a cache hit or miss
+	CacheResults map[string]uint64 `json:"cacheResults"`
+}
+
+func statsHandler(c echo.Context) error {
+	stats := Stats{
+		StatCounters: StatCounters{
+			Failures:        fetchFailures.snapshot(),
+			ManualOverrides: manualOverrides.snapshot()[""],
+			Fetches:         coalescedFetches.snapshot(),
+			CacheResults:    cacheResults.snapshot(),
+		},
+	}
+
+	if statsFlushInterval > 0 {
+		stats.Lifetime = &StatCounters{
+			Failures:        fetchFailures.lifetimeSnapshot(),
+			ManualOverrides: manualOverrides.lifetimeSnapshot()[""],
+			Fetches:         coalescedFetches.lifetimeSnapshot(),
+			CacheResults:    cacheResults.lifetimeSnapshot(),
+		}
+	}
+
+	return c.JSON(http.StatusOK, stats)
+}
+
+// loadStats sets the totals of previous runs of every counter, stored by name
+func loadStats(cache Cache) error {
+	if statsFlushInterval <= 0 {
+		return nil
+	}
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	for _, counter := range counters {
+		value, err := cache.Get(statsBucket, []byte(counter.name))
+		if err != nil {
+			return err
+		} else if value == nil {
+			continue
+		}
+
+		base := make(map[string]uint64)
+		if err := json.Unmarshal(value, &base); err != nil {
+			return err
+		}
+
+		counter.mu.Lock()
+		counter.base = base
+		counter.mu.Unlock()
+	}
+	return nil
+}
+
+// flushStats writes the lifetime totals of every counter
+func flushStats(cache Cache) error {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	for _, counter := range counters {
+		value, err := json.Marshal(counter.lifetime())
+		if err != nil {
+			return err
+		}
+		if err := cache.Put(statsBucket, []byte(counter.name), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runStatsFlusher periodically persists the counters' lifetime totals
+func runStatsFlusher(cache Cache) {
+	if statsFlushInterval <= 0 || readOnly {
+		return
+	}
+
+	for range time.Tick(statsFlushInterval) {
+		if err := flushStats(cache); err != nil {
+			log.Printf("stats: %v\n", err)
+		}
+	}
+}
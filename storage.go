@@ -0,0 +1,342 @@
+// This file contains the storage backends the cache can be kept in
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Cache is a bucketed key/value store. Get returns nil for missing keys and the
+// returned values are owned by the caller.
+type Cache interface {
+	Get(bucket, key []byte) ([]byte, error)
+	Put(bucket, key, value []byte) error
+	Delete(bucket, key []byte) error
+	ForEach(bucket []byte, fn func(key, value []byte) error) error
+	ForEachPrefix(bucket, prefix []byte, fn func(key, value []byte) error) error
+	Close() error
+}
+
+var (
+	// dbOpenTimeout bounds each attempt at locking the bolt file, which a crashed
+	// process can leave locked, and dbOpenRetries is how many more attempts are
+	// made, backing off from dbOpenBackoff
+	dbOpenTimeout = GetenvDurationOrDefault("RARITYMON_DB_OPEN_TIMEOUT", 5*time.Second)
+	dbOpenRetries = GetenvIntOrDefault("RARITYMON_DB_OPEN_RETRIES", 3)
+	dbOpenBackoff = GetenvDurationOrDefault("RARITYMON_DB_OPEN_BACKOFF", time.Second)
+
+	// dbFallbackMemory starts on the memory backend when the bolt file can't be
+	// opened, instead of exiting
+	dbFallbackMemory = GetenvBoolOrDefault("RARITYMON_DB_FALLBACK_MEMORY", false)
+
+	// degraded explains why the instance isn't running on its configured backend
+	degraded string
+)
+
+// openBolt opens the bolt file, retrying with a doubling backoff
+func openBolt(path string) (*bolt.DB, error) {
+	backoff := dbOpenBackoff
+
+	for attempt := 0; ; attempt++ {
+		db, err := bolt.Open(path, 0666, &bolt.Options{ReadOnly: readOnly, Timeout: dbOpenTimeout})
+		if err == nil || attempt >= dbOpenRetries {
+			return db, err
+		}
+
+		log.Printf("opening %s failed: %v, retrying in %s\n", path, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// openCache opens the backend selected by RARITYMON_CACHE_BACKEND
+func openCache() (Cache, error) {
+	switch backend := GetenvOrDefault("RARITYMON_CACHE_BACKEND", "bolt"); backend {
+	case "bolt":
+		path := GetenvOrDefault("RARITYMON_DB_PATH", "raritymon.db")
+		db, err := openBolt(path)
+		if err != nil && dbFallbackMemory {
+			degraded = fmt.Sprintf("couldn't open %s (%v), running on the memory backend", path, err)
+			log.Printf("DEGRADED: %s, nothing cached will outlive this process\n", degraded)
+			return newMemoryCache(), nil
+		} else if err != nil {
+			return nil, err
+		}
+		return &boltCache{db: db, path: path}, nil
+	case "memory":
+		return newMemoryCache(), nil
+	case "none":
+		return noCache{}, nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", backend)
+	}
+}
+
+// boltCache stores the cache in a bolt file. mu is only write locked while the
+// file is being swapped out by a compaction.
+type boltCache struct {
+	mu   sync.RWMutex
+	db   *bolt.DB
+	path string
+}
+
+func (b *boltCache) Get(bucket, key []byte) ([]byte, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var value []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if bkt := tx.Bucket(bucket); bkt != nil {
+			if v := bkt.Get(key); v != nil {
+				// bolt values are only valid for the lifetime of the transaction
+				value = append([]byte{}, v...)
+			}
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (b *boltCache) Put(bucket, key, value []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists(bucket)
+
+		if err != nil {
+			return err
+		}
+
+		return bkt.Put(key, value)
+	})
+}
+
+func (b *boltCache) Delete(bucket, key []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if bkt := tx.Bucket(bucket); bkt != nil {
+			return bkt.Delete(key)
+		}
+		return nil
+	})
+}
+
+func (b *boltCache) ForEach(bucket []byte, fn func(key, value []byte) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bucket)
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(fn)
+	})
+}
+
+// ForEachPrefix visits the keys starting with prefix, seeking straight to them
+func (b *boltCache) ForEachPrefix(bucket, prefix []byte, fn func(key, value []byte) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bucket)
+		if bkt == nil {
+			return nil
+		}
+
+		cursor := bkt.Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			if err := fn(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltCache) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.db.Close()
+}
+
+// Size returns the size of the bolt file in bytes
+func (b *boltCache) Size() int64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var size int64
+	b.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	return size
+}
+
+// Backup writes a consistent snapshot of the bolt file to w, without blocking
+// writes meanwhile
+func (b *boltCache) Backup(w io.Writer) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// FreeRatio returns the share of the file taken up by free pages
+func (b *boltCache) FreeRatio() float64 {
+	size := b.Size()
+	if size == 0 {
+		return 0
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return float64(b.db.Stats().FreeAlloc) / float64(size)
+}
+
+// Compact rewrites the bolt file without its free pages. Every other operation
+// waits until the compacted file has been swapped in.
+func (b *boltCache) Compact() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tmpPath := b.path + ".compact"
+	os.Remove(tmpPath)
+
+	dst, err := bolt.Open(tmpPath, 0666, nil)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := bolt.Compact(dst, b.db, 64*1024*1024); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := b.db.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// the database is closed from here on, so it's reopened whatever happens,
+	// from the original file when the rename fails
+	renameErr := os.Rename(tmpPath, b.path)
+	if renameErr != nil {
+		os.Remove(tmpPath)
+	}
+
+	db, err := bolt.Open(b.path, 0666, nil)
+	if err != nil {
+		return fmt.Errorf("reopening %s after compacting: %w", b.path, err)
+	}
+	b.db = db
+	return renameErr
+}
+
+// memoryCache keeps everything in process memory, for tests and stateless deployments
+type memoryCache struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{buckets: make(map[string]map[string][]byte)}
+}
+
+func (m *memoryCache) Get(bucket, key []byte) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	value, ok := m.buckets[string(bucket)][string(key)]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (m *memoryCache) Put(bucket, key, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bkt, ok := m.buckets[string(bucket)]
+	if !ok {
+		bkt = make(map[string][]byte)
+		m.buckets[string(bucket)] = bkt
+	}
+	bkt[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (m *memoryCache) Delete(bucket, key []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.buckets[string(bucket)], string(key))
+	return nil
+}
+
+// ForEach visits the keys in order, like bolt does. fn must not modify the cache.
+func (m *memoryCache) ForEach(bucket []byte, fn func(key, value []byte) error) error {
+	return m.ForEachPrefix(bucket, nil, fn)
+}
+
+func (m *memoryCache) ForEachPrefix(bucket, prefix []byte, fn func(key, value []byte) error) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	bkt := m.buckets[string(bucket)]
+	keys := make([]string, 0, len(bkt))
+	for key := range bkt {
+		if strings.HasPrefix(key, string(prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := fn([]byte(key), bkt[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryCache) Close() error {
+	return nil
+}
+
+// noCache stores nothing, every request goes upstream
+type noCache struct{}
+
+func (noCache) Get(bucket, key []byte) ([]byte, error)                        { return nil, nil }
+func (noCache) Put(bucket, key, value []byte) error                           { return nil }
+func (noCache) Delete(bucket, key []byte) error                               { return nil }
+func (noCache) ForEach(bucket []byte, fn func(key, value []byte) error) error { return nil }
+func (noCache) ForEachPrefix(bucket, prefix []byte, fn func(key, value []byte) error) error {
+	return nil
+}
+func (noCache) Close() error { return nil }
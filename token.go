@@ -0,0 +1,68 @@
+// This file contains the route for collections whose token ids aren't numbers,
+// such as hex ids, which are cached by the id as given
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// maxTokenLength is the longest string id accepted
+const maxTokenLength = 128
+
+// tokenKey is the context key the string id of a token route request is passed
+// under, see requestedEntry
+const tokenKey = "token"
+
+// fetchTokenAndCache is fetchAndCache for an item with a string id, cached under
+// that id. Tombstones, negative caching and fetch sharing only apply to numeric
+// ids.
+func fetchTokenAndCache(ctx context.Context, cache Cache, collection, token string) ([]byte, fetchTiming, error) {
+	requested := cacheEntry{Collection: collection, Token: token}
+	if entry, ok := getEntryByKey(cache, requested.key()); ok && entry.Pinned {
+		return entry.Item, fetchTiming{}, nil
+	}
+
+	encodedJson, page, warnings, timing, err := fetchEncoded(ctx, requested)
+	if err != nil {
+		return nil, timing, err
+	}
+
+	requested.Item, requested.ParseWarnings = encodedJson, warnings
+	if err := putCached(cache, requested, page); err != nil {
+		return nil, timing, err
+	}
+
+	return encodedJson, timing, nil
+}
+
+// tokenHandler serves items by a string id through the cache of the numeric item
+// route, TTLs, ?refresh and history included. Ids that are plain numbers are
+// served as they are there, so both routes share their cache entries.
+func tokenHandler(cache Cache) echo.HandlerFunc {
+	return tokenParam(cacheMiddleware(cache)(itemHandler(cache)))
+}
+
+// tokenParam passes the id of a token route request on to requestedEntry as a
+// string id, unless it's a plain number
+func tokenParam(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := url.PathUnescape(c.Param("id"))
+
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		} else if token == "" || len(token) > maxTokenLength {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("the id must be between 1 and %d characters", maxTokenLength))
+		}
+
+		if id, err := strconv.Atoi(token); err != nil || strconv.Itoa(id) != token {
+			c.Set(tokenKey, token)
+		}
+		return next(c)
+	}
+}
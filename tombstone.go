@@ -0,0 +1,68 @@
+// This file contains the tombstones stopping evicted items from being refetched,
+// and the negative cache remembering items that don't exist upstream
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+var (
+	tombstoneBucket = []byte("Tombstones")
+	negativeBucket  = []byte("NegativeCache")
+
+	// tombstoneTTL is how long evicted items are kept from being refetched when
+	// the eviction doesn't say otherwise, 0 means evictions don't tombstone
+	tombstoneTTL = GetenvDurationOrDefault("RARITYMON_TOMBSTONE_TTL", 0)
+
+	// negativeTTL is how long an item RarityMon said doesn't exist is reported
+	// missing without asking it again. Pages merely missing a node aren't
+	// remembered, since that's as likely to be a markup change. 0, the default,
+	// disables the negative cache.
+	negativeTTL = GetenvDurationOrDefault("RARITYMON_NEGATIVE_TTL", 0)
+
+	ErrorTombstoned = errors.New("item was evicted and won't be refetched for now")
+	ErrorNotFound   = errors.New("item was recently found not to exist")
+)
+
+// putMarker records that an item is in bucket until ttl has passed
+func putMarker(cache Cache, bucket []byte, collection string, id int, ttl time.Duration) error {
+	expires, err := time.Now().Add(ttl).MarshalText()
+
+	if err != nil {
+		return err
+	}
+
+	return cache.Put(bucket, cacheKey(collection, strconv.Itoa(id)), expires)
+}
+
+// hasMarker reports whether an item's marker in bucket is still live, clearing
+// it once it has expired
+func hasMarker(cache Cache, bucket []byte, collection string, id int) bool {
+	key := cacheKey(collection, strconv.Itoa(id))
+	value, err := cache.Get(bucket, key)
+
+	if err != nil || value == nil {
+		return false
+	}
+
+	expires := time.Time{}
+	if err := expires.UnmarshalText(value); err == nil && time.Now().Before(expires) {
+		return true
+	}
+
+	if !readOnly {
+		cache.Delete(bucket, key)
+	}
+	return false
+}
+
+func putTombstone(cache Cache, collection string, id int, ttl time.Duration) error {
+	return putMarker(cache, tombstoneBucket, collection, id, ttl)
+}
+
+// isTombstoned reports whether an item is inside its do-not-refetch window
+func isTombstoned(cache Cache, collection string, id int) bool {
+	return hasMarker(cache, tombstoneBucket, collection, id)
+}
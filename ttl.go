@@ -0,0 +1,106 @@
+// This file contains the expiry of cached items, with a TTL per collection
+// layered over the global one
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// cacheTTL is how long a scraped item is served from the cache before it's
+	// refetched, 0 keeps items until they're refreshed or flushed
+	cacheTTL = GetenvDurationOrDefault("RARITYMON_CACHE_TTL", 0)
+
+	// cacheTTLFile is a JSON object of collection TTL overrides, such as
+	// {"finished": "72h", "minting": "5m"}, with "0" never expiring a collection.
+	// It's read at startup and again on SIGHUP.
+	cacheTTLFile = GetenvOrDefault("RARITYMON_CACHE_TTL_FILE", "")
+
+	cacheTTLMu        sync.RWMutex
+	cacheTTLOverrides = make(map[string]time.Duration)
+)
+
+// loadCacheTTLs reads and validates cacheTTLFile, if one is configured. The
+// overrides in use are only replaced once the whole file is valid.
+func loadCacheTTLs() error {
+	if cacheTTLFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(cacheTTLFile)
+	if err != nil {
+		return err
+	}
+
+	raw := make(map[string]string)
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("%s: %w", cacheTTLFile, err)
+	}
+
+	loaded := make(map[string]time.Duration, len(raw))
+	for collection, val := range raw {
+		ttl, err := time.ParseDuration(val)
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("%s: %s has an invalid TTL %q", cacheTTLFile, collection, val)
+		}
+		loaded[collection] = ttl
+	}
+
+	cacheTTLMu.Lock()
+	cacheTTLOverrides = loaded
+	cacheTTLMu.Unlock()
+	return nil
+}
+
+// watchReloadSignal reloads the cache TTLs on every SIGHUP. Maintenance mode has
+// its own signal, so a reload never takes the service down.
+func watchReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		if cacheTTLFile == "" {
+			log.Println("no cache TTL file to reload")
+			continue
+		}
+
+		if err := loadCacheTTLs(); err != nil {
+			log.Printf("keeping the current cache TTLs: %v\n", err)
+		} else {
+			log.Printf("reloaded the cache TTLs from %s\n", cacheTTLFile)
+		}
+	}
+}
+
+// collectionTTL returns the cache TTL of a collection, 0 meaning it never expires
+func collectionTTL(collection string) time.Duration {
+	cacheTTLMu.RLock()
+	defer cacheTTLMu.RUnlock()
+
+	if ttl, ok := cacheTTLOverrides[collection]; ok {
+		return ttl
+	}
+	return cacheTTL
+}
+
+// entryExpired reports whether a cache entry outlived the TTL of its collection.
+// Manual and pinned entries never expire, partial entries and entries stored
+// before fetch times were recorded always have.
+func entryExpired(collection string, entry cacheEntry) bool {
+	if entry.Partial {
+		return true
+	}
+
+	ttl := collectionTTL(collection)
+	if ttl <= 0 || entry.Manual || entry.Pinned {
+		return false
+	}
+	return entry.FetchedAt == nil || time.Since(*entry.FetchedAt) >= ttl
+}
@@ -0,0 +1,72 @@
+// This file contains the double read mode, which fetches a page twice and only
+// trusts it when both reads agree, for collections whose pages render flakily
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// verifyCollections are always double read, other collections only when a
+	// request asks for ?verify=true
+	verifyCollections = strings.Split(GetenvOrDefault("RARITYMON_VERIFY_COLLECTIONS", ""), ",")
+
+	// verifyGap is how long to wait between the two reads
+	verifyGap = GetenvDurationOrDefault("RARITYMON_VERIFY_GAP", 500*time.Millisecond)
+
+	verifyReads = newCounter("raritymon_verify_reads_total", "Double read fetches by whether the two reads agreed", "collection", "outcome")
+)
+
+// verifyKey is the context key a request asking for a double read sets
+type verifyKey struct{}
+
+func withVerify(ctx context.Context) context.Context {
+	return context.WithValue(ctx, verifyKey{}, true)
+}
+
+// shouldVerify reports whether a fetch of collection should be double read
+func shouldVerify(ctx context.Context, collection string) bool {
+	if verify, _ := ctx.Value(verifyKey{}).(bool); verify {
+		return true
+	}
+
+	for _, verified := range verifyCollections {
+		if strings.TrimSpace(verified) == collection {
+			return true
+		}
+	}
+	return false
+}
+
+// readsAgree compares the parts of two reads of the same page a partial render
+// would get wrong
+func readsAgree(a, b *Item) bool {
+	return a.Rank == b.Rank && a.Total == b.Total && a.Score == b.Score && len(a.Traits) == len(b.Traits)
+}
+
+// verifyItem reads the page of item again after verifyGap. When the reads
+// disagree the second one is returned with a warning saying so.
+func verifyItem(ctx context.Context, entry cacheEntry, item *Item, timing *fetchTiming) (*Item, string, error) {
+	select {
+	case <-time.After(verifyGap):
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	}
+
+	second, page, err := fetchEntryItem(ctx, entry, timing)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if readsAgree(item, second) {
+		verifyReads.Inc(entry.Collection, "agreed")
+		return second, page, nil
+	}
+
+	verifyReads.Inc(entry.Collection, "disagreed")
+	second.Warnings = append(second.Warnings, fmt.Sprintf("verify: a second read disagreed with the first (rank %d, score %g, %d traits)", item.Rank, item.Score, len(item.Traits)))
+	return second, page, nil
+}
@@ -0,0 +1,34 @@
+// This file contains the endpoint reporting which build is running
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/labstack/echo/v4"
+)
+
+type Version struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`
+	GoVersion string `json:"goVersion"`
+
+	// ParserVersion is the salt of the cache keys, see RARITYMON_PARSER_VERSION
+	ParserVersion string `json:"parserVersion"`
+}
+
+func versionHandler(c echo.Context) error {
+	version := Version{Version: "(devel)", GoVersion: runtime.Version(), ParserVersion: parserVersion}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version.Version = info.Main.Version
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				version.Revision = setting.Value
+			}
+		}
+	}
+
+	return c.JSON(http.StatusOK, version)
+}